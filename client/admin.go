@@ -0,0 +1,69 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	golangnet "net"
+	"net/http"
+	"time"
+
+	"github.com/liudf0716/xfrps/models/config"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpServerReadTimeout  = 10 * time.Second
+	httpServerWriteTimeout = 10 * time.Second
+)
+
+// RunAdminServer serves local admin api to change proxies at runtime.
+func (svr *Service) RunAdminServer(addr string, port int64) (err error) {
+	// url router
+	router := httprouter.New()
+
+	// api, see admin_api.go
+	router.POST("/api/reload", httprouterBasicAuth(svr.apiReload))
+	router.GET("/api/status", httprouterBasicAuth(svr.apiStatus))
+	router.POST("/api/proxies", httprouterBasicAuth(svr.apiAddProxies))
+	router.DELETE("/api/proxies/:name", httprouterBasicAuth(svr.apiRemoveProxy))
+
+	ln, err := golangnet.Listen("tcp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:      router,
+		ReadTimeout:  httpServerReadTimeout,
+		WriteTimeout: httpServerWriteTimeout,
+	}
+	go server.Serve(ln)
+	return nil
+}
+
+func httprouterBasicAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, passwd, hasAuth := r.BasicAuth()
+		if (config.ClientCommonCfg.AdminUser == "" && config.ClientCommonCfg.AdminPwd == "") ||
+			(hasAuth && user == config.ClientCommonCfg.AdminUser && passwd == config.ClientCommonCfg.AdminPwd) {
+			h(w, r, ps)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+	}
+}
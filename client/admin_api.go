@@ -0,0 +1,133 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/liudf0716/xfrps/utils/log"
+
+	"github.com/julienschmidt/httprouter"
+	ini "github.com/vaughan0/go-ini"
+)
+
+type GeneralResponse struct {
+	Code int64  `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// api/reload, api/proxies
+type ProxiesChangeResp struct {
+	GeneralResponse
+
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+func (svr *Service) apiReload(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res ProxiesChangeResp
+	)
+	defer func() {
+		log.Info("Http response [/api/reload]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/reload]")
+
+	added, updated, removed, err := svr.ReloadConf()
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	} else {
+		res.Added = added
+		res.Updated = updated
+		res.Removed = removed
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/status
+type StatusResp struct {
+	GeneralResponse
+
+	Proxies []*ProxyStatus `json:"proxies"`
+}
+
+func (svr *Service) apiStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res StatusResp
+	)
+	defer func() {
+		log.Info("Http response [/api/status]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/status]")
+
+	res.Proxies = svr.ctl.GetProxyStatus()
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// body is proxy sections in the same format as configure file
+func (svr *Service) apiAddProxies(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res ProxiesChangeResp
+	)
+	defer func() {
+		log.Info("Http response [/api/proxies]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/proxies]")
+
+	conf, err := ini.Load(r.Body)
+	if err == nil {
+		res.Added, res.Updated, err = svr.AddProxies(conf)
+	}
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+func (svr *Service) apiRemoveProxy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res ProxiesChangeResp
+	)
+	name := params.ByName("name")
+	defer func() {
+		log.Info("Http response [/api/proxies/%s]: code [%d]", name, res.Code)
+	}()
+	log.Info("Http request: [/api/proxies/%s]", name)
+
+	removed, err := svr.RemoveProxy(name)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	} else {
+		res.Removed = removed
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
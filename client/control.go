@@ -15,10 +15,13 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	golangnet "net"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -50,12 +53,18 @@ type Control struct {
 	// proxies
 	proxies map[string]Proxy
 
+	// reasons of proxies closed by server, they are not registered again until their configures change
+	revokedPxys map[string]string
+
 	// control connection
 	conn net.Conn
 
 	// tcp stream multiplexing, if enabled
 	session *smux.Session
 
+	// TLS config for connections to server, nil if TLS is not enabled
+	tlsConfig *tls.Config
+
 	// put a message in this channel to send it over control connection to server
 	sendCh chan (msg.Message)
 
@@ -113,15 +122,16 @@ func NewControl(svr *Service, pxyCfgs map[string]config.ProxyConf) *Control {
 		RunId:     runId,
 	}
 	return &Control{
-		svr:      svr,
-		loginMsg: loginMsg,
-		pxyCfgs:  pxyCfgs,
-		proxies:  make(map[string]Proxy),
-		sendCh:   make(chan msg.Message, 10),
-		readCh:   make(chan msg.Message, 10),
-		closedCh: make(chan int),
-		Logger:   log.NewPrefixLogger(""),
-		runId:    runId,
+		svr:         svr,
+		loginMsg:    loginMsg,
+		pxyCfgs:     pxyCfgs,
+		proxies:     make(map[string]Proxy),
+		revokedPxys: make(map[string]string),
+		sendCh:      make(chan msg.Message, 10),
+		readCh:      make(chan msg.Message, 10),
+		closedCh:    make(chan int),
+		Logger:      log.NewPrefixLogger(""),
+		runId:       runId,
 	}
 }
 
@@ -134,6 +144,15 @@ func NewControl(svr *Service, pxyCfgs map[string]config.ProxyConf) *Control {
 // 7. In controler(): start new reader(), writer(), manager()
 // controler() will keep running
 func (ctl *Control) Run() error {
+	if config.ClientCommonCfg.TlsEnable {
+		tlsConfig, err := net.NewClientTlsConfig(config.ClientCommonCfg.TlsCertFile, config.ClientCommonCfg.TlsKeyFile,
+			config.ClientCommonCfg.TlsTrustedCaFile, config.ClientCommonCfg.TlsServerName, config.ClientCommonCfg.TlsInsecureSkipVerify)
+		if err != nil {
+			return fmt.Errorf("load TLS config error: %v", err)
+		}
+		ctl.tlsConfig = tlsConfig
+	}
+
 	for {
 		err := ctl.login()
 		if err != nil {
@@ -156,7 +175,7 @@ func (ctl *Control) Run() error {
 	go ctl.reader()
 
 	// send NewProxy message for all configured proxies
-	for _, cfg := range ctl.pxyCfgs {
+	for _, cfg := range ctl.getActiveProxyConfs() {
 		var newProxyMsg msg.NewProxy
 		cfg.UnMarshalToMsg(&newProxyMsg)
 		newProxyMsg.RunId = ctl.runId
@@ -179,8 +198,7 @@ func (ctl *Control) NewWorkConn() {
 		workConn = net.WrapConn(stream)
 
 	} else {
-		workConn, err = net.ConnectTcpServerByHttpProxy(config.ClientCommonCfg.HttpProxy,
-			fmt.Sprintf("%s:%d", config.ClientCommonCfg.ServerAddr, config.ClientCommonCfg.ServerPort))
+		workConn, err = ctl.connectServer()
 		if err != nil {
 			ctl.Warn("start new work connection error: %v", err)
 			return
@@ -202,10 +220,13 @@ func (ctl *Control) NewWorkConn() {
 		workConn.Close()
 		return
 	}
-	workConn.AddLogPrefix(startMsg.ProxyName)
+	workConn.AddLogField(log.FieldProxy, startMsg.ProxyName)
 
 	// dispatch this work connection to related proxy
-	if pxy, ok := ctl.proxies[startMsg.ProxyName]; ok {
+	ctl.mu.RLock()
+	pxy, ok := ctl.proxies[startMsg.ProxyName]
+	ctl.mu.RUnlock()
+	if ok {
 		workConn.Debug("start a new work connection: %s, localAddr: %s remoteAddr: %s",
 			startMsg.ProxyName, workConn.LocalAddr().String(), workConn.RemoteAddr().String())
 		go pxy.InWorkConn(workConn)
@@ -214,7 +235,34 @@ func (ctl *Control) NewWorkConn() {
 	}
 }
 
+// connectServer creates a new connection to server by tcp, kcp or websocket, wrapped with TLS if it's enabled.
+func (ctl *Control) connectServer() (conn net.Conn, err error) {
+	serverAddr := fmt.Sprintf("%s:%d", config.ClientCommonCfg.ServerAddr, config.ClientCommonCfg.ServerPort)
+	switch config.ClientCommonCfg.Protocol {
+	case "kcp":
+		conn, err = net.ConnectKcpServer(serverAddr)
+	case "websocket":
+		conn, err = net.ConnectWebsocketServer(config.ClientCommonCfg.HttpProxy, serverAddr)
+	default:
+		conn, err = net.ConnectTcpServerByProxy(config.ClientCommonCfg.HttpProxy, serverAddr)
+	}
+	if err != nil {
+		return
+	}
+	if ctl.tlsConfig != nil {
+		tlsConn, errRet := net.WrapTlsClientConn(conn, ctl.tlsConfig, config.ClientCommonCfg.TlsHeadByte)
+		if errRet != nil {
+			conn.Close()
+			return nil, errRet
+		}
+		conn = tlsConn
+	}
+	return
+}
+
 func (ctl *Control) init() {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
 	ctl.sendCh = make(chan msg.Message, 10)
 	ctl.readCh = make(chan msg.Message, 10)
 	ctl.closedCh = make(chan int)
@@ -229,8 +277,7 @@ func (ctl *Control) login() (err error) {
 		ctl.session.Close()
 	}
 
-	conn, err := net.ConnectTcpServerByHttpProxy(config.ClientCommonCfg.HttpProxy,
-		fmt.Sprintf("%s:%d", config.ClientCommonCfg.ServerAddr, config.ClientCommonCfg.ServerPort))
+	conn, err := ctl.connectServer()
 	if err != nil {
 		return err
 	}
@@ -281,11 +328,13 @@ func (ctl *Control) login() (err error) {
 	// update runId got from server
 	ctl.runId = loginRespMsg.RunId
 	ctl.ClearLogPrefix()
-	ctl.AddLogPrefix(loginRespMsg.RunId)
+	ctl.AddLogField(log.FieldRunId, loginRespMsg.RunId)
 	ctl.Info("login to server success, get run id [%s]", loginRespMsg.RunId)
 
 	// login success, so we let closedCh available again
+	ctl.mu.Lock()
 	ctl.closedCh = make(chan int)
+	ctl.mu.Unlock()
 	ctl.lastPong = time.Now()
 
 	return nil
@@ -386,9 +435,11 @@ func (ctl *Control) manager() {
 					ctl.Warn("[%s] start error: %s", m.ProxyName, m.Error)
 					continue
 				}
+				ctl.mu.Lock()
 				cfg, ok := ctl.pxyCfgs[m.ProxyName]
 				if !ok {
-					// it will never go to this branch now
+					// proxy may be removed before server responds
+					ctl.mu.Unlock()
 					ctl.Warn("[%s] no proxy conf found", m.ProxyName)
 					continue
 				}
@@ -403,6 +454,7 @@ func (ctl *Control) manager() {
 						ftpCfg := ctl.pxyCfgs[cfgType.FtpCfgProxyName]
 						ftpCfgType, ok := ftpCfg.(*config.FtpProxyConf)
 						if !ok {
+							ctl.mu.Unlock()
 							ctl.Warn("[%s] is not Ftp proxy", cfgType.FtpCfgProxyName)
 							continue
 						}
@@ -413,14 +465,44 @@ func (ctl *Control) manager() {
 				oldPxy, ok := ctl.proxies[m.ProxyName]
 				if ok {
 					oldPxy.Close()
+					delete(ctl.proxies, m.ProxyName)
 				}
 				pxy := NewProxy(ctl, cfg)
 				if err := pxy.Run(); err != nil {
+					ctl.mu.Unlock()
 					ctl.Warn("[%s] proxy start running error: %v", m.ProxyName, err)
 					continue
 				}
 				ctl.proxies[m.ProxyName] = pxy
+				ctl.mu.Unlock()
 				ctl.Info("[%s] start proxy success", m.ProxyName)
+			case *msg.CloseProxy:
+				ctl.Warn("[%s] proxy is closed by server: %s", m.ProxyName, m.Reason)
+				ctl.mu.Lock()
+				if pxy, ok := ctl.proxies[m.ProxyName]; ok {
+					pxy.Close()
+					delete(ctl.proxies, m.ProxyName)
+				}
+				cfg, ok := ctl.pxyCfgs[m.ProxyName]
+				if ok && m.RemotePort != 0 {
+					// port is changed by server, register it again with the new port
+					cfg.FillRemotePort(m.RemotePort)
+					var newProxyMsg msg.NewProxy
+					cfg.UnMarshalToMsg(&newProxyMsg)
+					newProxyMsg.RunId = ctl.runId
+					sendCh := ctl.sendCh
+					closedCh := ctl.closedCh
+					ctl.mu.Unlock()
+
+					// not with ctl.mu locked, controler locks it before closing sendCh
+					if err := ctl.sendMsg(sendCh, closedCh, &newProxyMsg); err != nil {
+						ctl.Warn("[%s] send new proxy message error: %v", m.ProxyName, err)
+					}
+					continue
+				} else if ok {
+					ctl.revokedPxys[m.ProxyName] = m.Reason
+				}
+				ctl.mu.Unlock()
 			case *msg.Pong:
 				ctl.lastPong = time.Now()
 				ctl.Debug("receive heartbeat from server")
@@ -441,24 +523,34 @@ func (ctl *Control) controler() {
 		select {
 		case <-checkProxyTicker.C:
 			// Every 30 seconds, check which proxy registered failed and reregister it to server.
-			for _, cfg := range ctl.pxyCfgs {
-				if _, exist := ctl.proxies[cfg.GetName()]; !exist {
-					ctl.Info("try to reregister proxy [%s]", cfg.GetName())
-					var newProxyMsg msg.NewProxy
-					cfg.UnMarshalToMsg(&newProxyMsg)
-					ctl.sendCh <- &newProxyMsg
+			ctl.mu.RLock()
+			failedCfgs := make([]config.ProxyConf, 0)
+			for name, cfg := range ctl.pxyCfgs {
+				_, exist := ctl.proxies[name]
+				_, revoked := ctl.revokedPxys[name]
+				if !exist && !revoked {
+					failedCfgs = append(failedCfgs, cfg)
 				}
 			}
+			ctl.mu.RUnlock()
+			for _, cfg := range failedCfgs {
+				ctl.Info("try to reregister proxy [%s]", cfg.GetName())
+				var newProxyMsg msg.NewProxy
+				cfg.UnMarshalToMsg(&newProxyMsg)
+				ctl.sendCh <- &newProxyMsg
+			}
 		case _, ok := <-ctl.closedCh:
 			// we won't get any variable from this channel
 			if !ok {
 				// close related channels
+				ctl.mu.Lock()
 				close(ctl.readCh)
 				close(ctl.sendCh)
 
 				for _, pxy := range ctl.proxies {
 					pxy.Close()
 				}
+				ctl.mu.Unlock()
 				time.Sleep(time.Second)
 
 				// loop util reconnect to server success
@@ -488,7 +580,7 @@ func (ctl *Control) controler() {
 				go ctl.reader()
 
 				// send NewProxy message for all configured proxies
-				for _, cfg := range ctl.pxyCfgs {
+				for _, cfg := range ctl.getActiveProxyConfs() {
 					var newProxyMsg msg.NewProxy
 					cfg.UnMarshalToMsg(&newProxyMsg)
 					ctl.sendCh <- &newProxyMsg
@@ -503,7 +595,9 @@ func (ctl *Control) controler() {
 
 // get ProxyConf by user defined name
 func (ctl *Control) getProxyConfByName(name string) (cfg config.ProxyConf, ok bool) {
+	ctl.mu.RLock()
 	cfg, ok = ctl.pxyCfgs[name]
+	ctl.mu.RUnlock()
 	if !ok {
 		// it should never go to this branch now
 		ctl.Warn("[%s] no proxy conf found", name)
@@ -511,3 +605,177 @@ func (ctl *Control) getProxyConfByName(name string) (cfg config.ProxyConf, ok bo
 	ok = true
 	return
 }
+
+// getProxyConfs returns a copy of proxy configures, so callers can iterate it without lock.
+func (ctl *Control) getProxyConfs() map[string]config.ProxyConf {
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	cfgs := make(map[string]config.ProxyConf, len(ctl.pxyCfgs))
+	for name, cfg := range ctl.pxyCfgs {
+		cfgs[name] = cfg
+	}
+	return cfgs
+}
+
+// getActiveProxyConfs returns proxy configures except those revoked by server.
+func (ctl *Control) getActiveProxyConfs() map[string]config.ProxyConf {
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	cfgs := make(map[string]config.ProxyConf, len(ctl.pxyCfgs))
+	for name, cfg := range ctl.pxyCfgs {
+		if _, ok := ctl.revokedPxys[name]; !ok {
+			cfgs[name] = cfg
+		}
+	}
+	return cfgs
+}
+
+// UpdateProxies replaces proxy configures with pxyCfgs.
+// Removed proxies are closed locally and on server by CloseProxy messages,
+// changed proxies are closed locally and replaced on server by NewProxy messages, other proxies keep running.
+func (ctl *Control) UpdateProxies(pxyCfgs map[string]config.ProxyConf) (added []string, updated []string, removed []string) {
+	added = make([]string, 0)
+	updated = make([]string, 0)
+	removed = make([]string, 0)
+	closedPxys := make([]Proxy, 0)
+
+	ctl.mu.Lock()
+	newCfgs := make(map[string]config.ProxyConf, len(pxyCfgs))
+	for name, cfg := range pxyCfgs {
+		oldCfg, ok := ctl.pxyCfgs[name]
+		if !ok {
+			added = append(added, name)
+			newCfgs[name] = cfg
+		} else if proxyConfChanged(oldCfg, cfg) {
+			updated = append(updated, name)
+			newCfgs[name] = cfg
+		} else {
+			// keep the old one, it has remote ports got from server
+			newCfgs[name] = oldCfg
+		}
+	}
+	for name := range ctl.pxyCfgs {
+		if _, ok := pxyCfgs[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for _, name := range append(removed, updated...) {
+		if pxy, ok := ctl.proxies[name]; ok {
+			closedPxys = append(closedPxys, pxy)
+			delete(ctl.proxies, name)
+		}
+		delete(ctl.revokedPxys, name)
+	}
+	for _, name := range added {
+		delete(ctl.revokedPxys, name)
+	}
+	ctl.pxyCfgs = newCfgs
+	sendCh := ctl.sendCh
+	closedCh := ctl.closedCh
+	ctl.mu.Unlock()
+
+	for _, pxy := range closedPxys {
+		pxy.Close()
+	}
+
+	// If control connection is broken now, all proxies will be registered again after relogin.
+	for _, name := range removed {
+		ctl.Info("[%s] close proxy", name)
+		if err := ctl.sendMsg(sendCh, closedCh, &msg.CloseProxy{ProxyName: name}); err != nil {
+			ctl.Warn("[%s] send close proxy message error: %v", name, err)
+			return
+		}
+	}
+	for _, name := range append(added, updated...) {
+		var newProxyMsg msg.NewProxy
+		newCfgs[name].UnMarshalToMsg(&newProxyMsg)
+		newProxyMsg.RunId = ctl.runId
+		if err := ctl.sendMsg(sendCh, closedCh, &newProxyMsg); err != nil {
+			ctl.Warn("[%s] send new proxy message error: %v", name, err)
+			return
+		}
+	}
+	return
+}
+
+// sendMsg sends m to server unless control connection is closed.
+func (ctl *Control) sendMsg(sendCh chan msg.Message, closedCh chan int, m msg.Message) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("control connection is closed")
+		}
+	}()
+
+	select {
+	case sendCh <- m:
+	case <-closedCh:
+		err = fmt.Errorf("control connection is closed")
+	}
+	return
+}
+
+// proxyConfChanged checks if newCfg is different from oldCfg.
+// Remote ports got from server and local server of ftp data proxy are ignored.
+func proxyConfChanged(oldCfg config.ProxyConf, newCfg config.ProxyConf) bool {
+	if reflect.TypeOf(oldCfg) != reflect.TypeOf(newCfg) {
+		return true
+	}
+
+	v := reflect.New(reflect.TypeOf(newCfg).Elem())
+	v.Elem().Set(reflect.ValueOf(newCfg).Elem())
+	cfg := v.Interface().(config.ProxyConf)
+
+	var oldMsg, newMsg msg.NewProxy
+	oldCfg.UnMarshalToMsg(&oldMsg)
+	cfg.UnMarshalToMsg(&newMsg)
+	if newMsg.RemotePort == 0 {
+		cfg.FillRemotePort(oldMsg.RemotePort)
+	}
+	switch c := cfg.(type) {
+	case *config.FtpProxyConf:
+		if c.RemoteDataPort == 0 {
+			c.RemoteDataPort = oldMsg.RemoteDataPort
+		}
+	case *config.TcpProxyConf:
+		if c.FtpCfgProxyName != "" {
+			c.LocalSvrConf = oldCfg.(*config.TcpProxyConf).LocalSvrConf
+		}
+	}
+	return !reflect.DeepEqual(oldCfg, cfg)
+}
+
+type ProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	RemotePort int64  `json:"remote_port"`
+}
+
+// GetProxyStatus returns all configured proxies, proxies not started by server yet are waiting,
+// and proxies revoked by server are closed with the reason in Err.
+func (ctl *Control) GetProxyStatus() []*ProxyStatus {
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	ps := make([]*ProxyStatus, 0, len(ctl.pxyCfgs))
+	for name, cfg := range ctl.pxyCfgs {
+		var m msg.NewProxy
+		cfg.UnMarshalToMsg(&m)
+		status := "waiting"
+		reason, revoked := ctl.revokedPxys[name]
+		if _, ok := ctl.proxies[name]; ok {
+			status = "running"
+		} else if revoked {
+			status = "closed"
+		}
+		ps = append(ps, &ProxyStatus{
+			Name:       name,
+			Type:       cfg.GetBaseInfo().ProxyType,
+			Status:     status,
+			Err:        reason,
+			RemotePort: m.RemotePort,
+		})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
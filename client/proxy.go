@@ -46,7 +46,7 @@ type Proxy interface {
 func NewProxy(ctl *Control, pxyConf config.ProxyConf) (pxy Proxy) {
 	baseProxy := BaseProxy{
 		ctl:    ctl,
-		Logger: log.NewPrefixLogger(pxyConf.GetName()),
+		Logger: log.NewFieldLogger(log.FieldProxy, pxyConf.GetName()),
 	}
 	switch cfg := pxyConf.(type) {
 	case *config.TcpProxyConf:
@@ -14,13 +14,25 @@
 
 package client
 
-import "github.com/liudf0716/xfrps/models/config"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/consts"
+	"github.com/liudf0716/xfrps/utils/log"
+
+	ini "github.com/vaughan0/go-ini"
+)
 
 type Service struct {
 	// manager control connection with server
 	ctl *Control
 
 	closedCh chan int
+
+	// only one change of proxies at the same time
+	reloadMu sync.Mutex
 }
 
 func NewService(pxyCfgs map[string]config.ProxyConf) (svr *Service) {
@@ -33,6 +45,14 @@ func NewService(pxyCfgs map[string]config.ProxyConf) (svr *Service) {
 }
 
 func (svr *Service) Run() error {
+	if config.ClientCommonCfg.AdminPort != 0 {
+		err := svr.RunAdminServer(config.ClientCommonCfg.AdminAddr, config.ClientCommonCfg.AdminPort)
+		if err != nil {
+			return fmt.Errorf("Create admin server error: %v", err)
+		}
+		log.Info("admin server listen on %s:%d", config.ClientCommonCfg.AdminAddr, config.ClientCommonCfg.AdminPort)
+	}
+
 	err := svr.ctl.Run()
 	if err != nil {
 		return err
@@ -41,3 +61,62 @@ func (svr *Service) Run() error {
 	<-svr.closedCh
 	return nil
 }
+
+// ReloadConf loads proxies from configure file again and applies the difference.
+// Configures in common section are not reloaded.
+func (svr *Service) ReloadConf() (added []string, updated []string, removed []string, err error) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+
+	conf, err := ini.LoadFile(config.ClientCommonCfg.ConfigFile)
+	if err != nil {
+		return
+	}
+	pxyCfgs, err := config.LoadProxyConfFromFile(config.ClientCommonCfg.User, conf, config.ClientCommonCfg.Start)
+	if err != nil {
+		return
+	}
+	added, updated, removed = svr.ctl.UpdateProxies(pxyCfgs)
+	return
+}
+
+// AddProxies adds proxies in conf, proxies with the same name are replaced.
+func (svr *Service) AddProxies(conf ini.File) (added []string, updated []string, err error) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+
+	newCfgs, err := config.LoadProxyConfFromFile(config.ClientCommonCfg.User, conf, nil)
+	if err != nil {
+		return
+	}
+	if len(newCfgs) == 0 {
+		err = fmt.Errorf("no proxy found")
+		return
+	}
+
+	pxyCfgs := svr.ctl.getProxyConfs()
+	for name, cfg := range newCfgs {
+		pxyCfgs[name] = cfg
+	}
+	added, updated, _ = svr.ctl.UpdateProxies(pxyCfgs)
+	return
+}
+
+// RemoveProxy removes the proxy named name in configure file, with its ftp data proxy if it's ftp.
+func (svr *Service) RemoveProxy(name string) (removed []string, err error) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+
+	if config.ClientCommonCfg.User != "" {
+		name = config.ClientCommonCfg.User + "." + name
+	}
+	pxyCfgs := svr.ctl.getProxyConfs()
+	if _, ok := pxyCfgs[name]; !ok {
+		err = fmt.Errorf("proxy [%s] not found", name)
+		return
+	}
+	delete(pxyCfgs, name)
+	delete(pxyCfgs, name+consts.FtpDataProxySuffix)
+	_, _, removed = svr.ctl.UpdateProxies(pxyCfgs)
+	return
+}
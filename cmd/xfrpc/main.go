@@ -70,6 +70,7 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	config.ClientCommonCfg.ConfigFile = confFile
 
 	if args["-L"] != nil {
 		if args["-L"].(string) == "console" {
@@ -113,7 +114,9 @@ func main() {
 	}
 
 	log.InitLog(config.ClientCommonCfg.LogWay, config.ClientCommonCfg.LogFile,
-		config.ClientCommonCfg.LogLevel, config.ClientCommonCfg.LogMaxDays)
+		config.ClientCommonCfg.LogLevel, config.ClientCommonCfg.LogMaxDays, config.ClientCommonCfg.LogFormat,
+		config.ClientCommonCfg.LogMaxSize, int(config.ClientCommonCfg.LogMaxFiles), config.ClientCommonCfg.LogCompress)
+	go log.HandleReopenSignal()
 
 	svr := client.NewService(pxyCfgs)
 	err = svr.Run()
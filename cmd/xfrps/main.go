@@ -17,8 +17,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	docopt "github.com/docopt/docopt-go"
 	ini "github.com/vaughan0/go-ini"
@@ -55,64 +57,105 @@ func main() {
 		confFile = args["-c"].(string)
 	}
 
-	conf, err := ini.LoadFile(confFile)
+	cfg, err := loadConf(confFile, args)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	config.ServerCommonCfg, err = config.LoadServerCommonConf(conf)
+	config.SetServerCommonCfg(cfg)
+
+	if args["-v"] != nil {
+		if args["-v"].(bool) {
+			fmt.Println(version.Full())
+			os.Exit(0)
+		}
+	}
+
+	log.InitLog(cfg.LogWay, cfg.LogFile, cfg.LogLevel, cfg.LogMaxDays, cfg.LogFormat,
+		cfg.LogMaxSize, int(cfg.LogMaxFiles), cfg.LogCompress)
+	go log.HandleReopenSignal()
+
+	svr, err := server.NewService()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	log.Info("Start frps success")
+	if cfg.PrivilegeMode == true {
+		log.Info("PrivilegeMode is enabled, you should pay more attention to security issues")
+	}
+	server.ServerService = svr
+	svr.SetConfLoader(func() (*config.ServerCommonConf, error) {
+		return loadConf(confFile, args)
+	})
+	go handleReloadSignal(svr)
+	go handleExitSignal(svr)
+	svr.Run()
+}
+
+// loadConf loads configure file, then replaces configures by those from command line.
+func loadConf(confFile string, args map[string]interface{}) (cfg *config.ServerCommonConf, err error) {
+	conf, err := ini.LoadFile(confFile)
+	if err != nil {
+		return
+	}
+	cfg, err = config.LoadServerCommonConf(conf)
+	if err != nil {
+		return
+	}
+	cfg.ConfigFile = confFile
 
 	if args["-L"] != nil {
 		if args["-L"].(string) == "console" {
-			config.ServerCommonCfg.LogWay = "console"
+			cfg.LogWay = "console"
 		} else {
-			config.ServerCommonCfg.LogWay = "file"
-			config.ServerCommonCfg.LogFile = args["-L"].(string)
+			cfg.LogWay = "file"
+			cfg.LogFile = args["-L"].(string)
 		}
 	}
 
 	if args["--log-level"] != nil {
-		config.ServerCommonCfg.LogLevel = args["--log-level"].(string)
+		cfg.LogLevel = args["--log-level"].(string)
 	}
 
 	if args["--addr"] != nil {
 		addr := strings.Split(args["--addr"].(string), ":")
 		if len(addr) != 2 {
-			fmt.Println("--addr format error: example 0.0.0.0:7000")
-			os.Exit(1)
+			err = fmt.Errorf("--addr format error: example 0.0.0.0:7000")
+			return
+		}
+		bindPort, errRet := strconv.ParseInt(addr[1], 10, 64)
+		if errRet != nil {
+			err = fmt.Errorf("--addr format error, example 0.0.0.0:7000")
+			return
 		}
-		bindPort, err := strconv.ParseInt(addr[1], 10, 64)
-		if err != nil {
-			fmt.Println("--addr format error, example 0.0.0.0:7000")
-			os.Exit(1)
+		cfg.BindAddr = addr[0]
+		cfg.BindPort = bindPort
+		// dashboard follows bind port unless its port is set
+		if tmpStr, ok := conf.Get("common", "dashboard_port"); !ok || tmpStr == "0" {
+			cfg.DashboardPort = bindPort + 1
 		}
-		config.ServerCommonCfg.BindAddr = addr[0]
-		config.ServerCommonCfg.BindPort = bindPort
 	}
+	return
+}
 
-	if args["-v"] != nil {
-		if args["-v"].(bool) {
-			fmt.Println(version.Full())
-			os.Exit(0)
+// handleReloadSignal reloads configures when SIGHUP is received.
+func handleReloadSignal(svr *server.Service) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if _, _, err := svr.ReloadConf(); err != nil {
+			log.Warn("reload configures error: %v", err)
 		}
 	}
+}
 
-	log.InitLog(config.ServerCommonCfg.LogWay, config.ServerCommonCfg.LogFile,
-		config.ServerCommonCfg.LogLevel, config.ServerCommonCfg.LogMaxDays)
-
-	svr, err := server.NewService()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	log.Info("Start frps success")
-	if config.ServerCommonCfg.PrivilegeMode == true {
-		log.Info("PrivilegeMode is enabled, you should pay more attention to security issues")
-	}
-	server.ServerService = svr
-	svr.Run()
+// handleExitSignal saves statistics before exiting when SIGINT or SIGTERM is received.
+func handleExitSignal(svr *server.Service) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	log.Info("receive signal [%v], exiting", sig)
+	svr.SaveStats()
+	os.Exit(0)
 }
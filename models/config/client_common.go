@@ -16,10 +16,13 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/liudf0716/xfrps/utils/util"
+
 	ini "github.com/vaughan0/go-ini"
 )
 
@@ -34,7 +37,11 @@ type ClientCommonConf struct {
 	LogFile           string
 	LogWay            string
 	LogLevel          string
+	LogFormat         string // text or json
 	LogMaxDays        int64
+	LogMaxSize        int64
+	LogMaxFiles       int64
+	LogCompress       bool
 	PrivilegeToken    string
 	PoolCount         int
 	TcpMux            bool
@@ -47,6 +54,35 @@ type ClientCommonConf struct {
 	// added by liudf
 	UseEncryption bool
 	UseCompressed bool
+
+	// if TlsEnable is true, connections to server use TLS
+	TlsEnable bool
+
+	// certificate sent to server if it requires mutual TLS
+	TlsCertFile string
+	TlsKeyFile  string
+
+	// if TlsTrustedCaFile is not empty, server's certificate must be signed by it, otherwise system roots are used
+	TlsTrustedCaFile string
+
+	// if TlsInsecureSkipVerify is true, server's certificate is not verified
+	TlsInsecureSkipVerify bool
+
+	// if TlsHeadByte is true, a non-standard byte is sent before TLS handshake,
+	// it's required if xfrps shares bind_port with vhost https or dashboard over TLS
+	TlsHeadByte bool
+
+	// server name to verify server's certificate, ServerAddr is used if it's empty
+	TlsServerName string
+
+	// protocol for connecting to server, tcp, kcp or websocket, HttpProxy is not used by kcp
+	Protocol string
+
+	// local admin api to reload proxies, disabled if AdminPort is 0
+	AdminAddr string
+	AdminPort int64
+	AdminUser string
+	AdminPwd  string
 }
 
 func GetDeaultClientCommonConf() *ClientCommonConf {
@@ -58,7 +94,11 @@ func GetDeaultClientCommonConf() *ClientCommonConf {
 		LogFile:           "console",
 		LogWay:            "console",
 		LogLevel:          "info",
+		LogFormat:         "text",
 		LogMaxDays:        3,
+		LogMaxSize:        0,
+		LogMaxFiles:       10,
+		LogCompress:       false,
 		PrivilegeToken:    "",
 		PoolCount:         1,
 		TcpMux:            false,
@@ -69,6 +109,11 @@ func GetDeaultClientCommonConf() *ClientCommonConf {
 		HeartBeatTimeout:  90,
 		UseEncryption:     false,
 		UseCompressed:     false,
+		Protocol:          "tcp",
+		AdminAddr:         "127.0.0.1",
+		AdminPort:         0,
+		AdminUser:         "",
+		AdminPwd:          "",
 	}
 }
 
@@ -97,6 +142,20 @@ func LoadClientCommonConf(conf ini.File) (cfg *ClientCommonConf, err error) {
 		// get http_proxy from env
 		cfg.HttpProxy = os.Getenv("http_proxy")
 	}
+	// http_proxy can be a socks5 proxy too
+	if cfg.HttpProxy != "" && !strings.HasPrefix(cfg.HttpProxy, "http://") && !strings.HasPrefix(cfg.HttpProxy, "socks5://") {
+		err = fmt.Errorf("Parse conf error: http_proxy should be http://host:port or socks5://host:port")
+		return
+	}
+
+	tmpStr, ok = conf.Get("common", "protocol")
+	if ok {
+		if tmpStr != "tcp" && tmpStr != "kcp" && tmpStr != "websocket" {
+			err = fmt.Errorf("Parse conf error: protocol should be tcp, kcp or websocket")
+			return
+		}
+		cfg.Protocol = tmpStr
+	}
 
 	tmpStr, ok = conf.Get("common", "log_file")
 	if ok {
@@ -113,11 +172,41 @@ func LoadClientCommonConf(conf ini.File) (cfg *ClientCommonConf, err error) {
 		cfg.LogLevel = tmpStr
 	}
 
+	tmpStr, ok = conf.Get("common", "log_format")
+	if ok {
+		if tmpStr != "text" && tmpStr != "json" {
+			err = fmt.Errorf("Parse conf error: log_format should be text or json")
+			return
+		}
+		cfg.LogFormat = tmpStr
+	}
+
 	tmpStr, ok = conf.Get("common", "log_max_days")
 	if ok {
 		cfg.LogMaxDays, _ = strconv.ParseInt(tmpStr, 10, 64)
 	}
 
+	tmpStr, ok = conf.Get("common", "log_max_size")
+	if ok {
+		if cfg.LogMaxSize, err = util.ParseSize(tmpStr); err != nil {
+			err = fmt.Errorf("Parse conf error: log_max_size is incorrect")
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "log_max_files")
+	if ok {
+		if cfg.LogMaxFiles, err = strconv.ParseInt(tmpStr, 10, 64); err != nil || cfg.LogMaxFiles < 0 {
+			err = fmt.Errorf("Parse conf error: log_max_files is incorrect")
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "log_compress")
+	if ok && tmpStr == "true" {
+		cfg.LogCompress = true
+	}
+
 	tmpStr, ok = conf.Get("common", "privilege_token")
 	if ok {
 		cfg.PrivilegeToken = tmpStr
@@ -191,5 +280,86 @@ func LoadClientCommonConf(conf ini.File) (cfg *ClientCommonConf, err error) {
 		err = fmt.Errorf("Parse conf error: heartbeat_timeout is incorrect, heartbeat_timeout is less than heartbeat_interval")
 		return
 	}
+
+	tmpStr, ok = conf.Get("common", "tls_enable")
+	if ok && tmpStr == "true" {
+		cfg.TlsEnable = true
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_cert_file")
+	if ok {
+		cfg.TlsCertFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_key_file")
+	if ok {
+		cfg.TlsKeyFile = tmpStr
+	}
+
+	if (cfg.TlsCertFile == "") != (cfg.TlsKeyFile == "") {
+		err = fmt.Errorf("Parse conf error: tls_cert_file and tls_key_file must be set together")
+		return
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_trusted_ca_file")
+	if ok {
+		cfg.TlsTrustedCaFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_insecure_skip_verify")
+	if ok && tmpStr == "true" {
+		cfg.TlsInsecureSkipVerify = true
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_head_byte")
+	if ok && tmpStr == "true" {
+		cfg.TlsHeadByte = true
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_server_name")
+	if ok {
+		cfg.TlsServerName = tmpStr
+	} else {
+		cfg.TlsServerName = cfg.ServerAddr
+	}
+
+	tmpStr, ok = conf.Get("common", "admin_addr")
+	if ok {
+		cfg.AdminAddr = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "admin_port")
+	if ok {
+		v, err = strconv.ParseInt(tmpStr, 10, 64)
+		if err != nil || v < 0 || v > 65535 {
+			err = fmt.Errorf("Parse conf error: admin_port is incorrect")
+			return
+		}
+		cfg.AdminPort = v
+	}
+
+	tmpStr, ok = conf.Get("common", "admin_user")
+	if ok {
+		cfg.AdminUser = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "admin_pwd")
+	if ok {
+		cfg.AdminPwd = tmpStr
+	}
+
+	// admin api changes proxies, it's only served without authentication on loopback address
+	if cfg.AdminPort != 0 && cfg.AdminUser == "" && cfg.AdminPwd == "" && !isLoopbackAddr(cfg.AdminAddr) {
+		err = fmt.Errorf("Parse conf error: admin_user and admin_pwd are required if admin_addr isn't a loopback address")
+		return
+	}
 	return
 }
+
+func isLoopbackAddr(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
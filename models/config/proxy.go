@@ -23,6 +23,7 @@ import (
 	"github.com/liudf0716/xfrps/models/consts"
 	"github.com/liudf0716/xfrps/models/msg"
 
+	"github.com/liudf0716/xfrps/utils/limit"
 	"github.com/liudf0716/xfrps/utils/util"
 	ini "github.com/vaughan0/go-ini"
 )
@@ -95,8 +96,12 @@ type BaseProxyConf struct {
 	ProxyName string `json:"proxy_name"`
 	ProxyType string `json:"proxy_type"`
 
-	UseEncryption  bool `json:"use_encryption"`
-	UseCompression bool `json:"use_compression"`
+	UseEncryption  bool   `json:"use_encryption"`
+	UseCompression bool   `json:"use_compression"`
+	BandwidthLimit string `json:"bandwidth_limit"`
+
+	AllowIps []string `json:"allow_ips"`
+	DenyIps  []string `json:"deny_ips"`
 }
 
 func (cfg *BaseProxyConf) GetName() string {
@@ -112,6 +117,9 @@ func (cfg *BaseProxyConf) LoadFromMsg(pMsg *msg.NewProxy) {
 	cfg.ProxyType = pMsg.ProxyType
 	cfg.UseEncryption = pMsg.UseEncryption
 	cfg.UseCompression = pMsg.UseCompression
+	cfg.BandwidthLimit = pMsg.BandwidthLimit
+	cfg.AllowIps = pMsg.AllowIps
+	cfg.DenyIps = pMsg.DenyIps
 }
 
 func (cfg *BaseProxyConf) LoadFromFile(name string, section ini.Section) error {
@@ -135,6 +143,34 @@ func (cfg *BaseProxyConf) LoadFromFile(name string, section ini.Section) error {
 	if ok && tmpStr == "true" {
 		cfg.UseCompression = true
 	}
+
+	tmpStr, ok = section["bandwidth_limit"]
+	if ok {
+		if _, err := limit.ParseBandwidth(tmpStr); err != nil {
+			return fmt.Errorf("Parse conf error: proxy [%s] bandwidth_limit error", name)
+		}
+		cfg.BandwidthLimit = tmpStr
+	}
+
+	for _, item := range []struct {
+		key string
+		ips *[]string
+	}{
+		{"allow_ips", &cfg.AllowIps},
+		{"deny_ips", &cfg.DenyIps},
+	} {
+		if tmpStr, ok = section[item.key]; !ok {
+			continue
+		}
+		if _, err := util.GetIpNets(tmpStr); err != nil {
+			return fmt.Errorf("Parse conf error: proxy [%s] %s error, %v", name, item.key, err)
+		}
+		for _, ip := range strings.Split(tmpStr, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				*item.ips = append(*item.ips, ip)
+			}
+		}
+	}
 	return nil
 }
 
@@ -143,6 +179,9 @@ func (cfg *BaseProxyConf) UnMarshalToMsg(pMsg *msg.NewProxy) {
 	pMsg.ProxyType = cfg.ProxyType
 	pMsg.UseEncryption = cfg.UseEncryption
 	pMsg.UseCompression = cfg.UseCompression
+	pMsg.BandwidthLimit = cfg.BandwidthLimit
+	pMsg.AllowIps = cfg.AllowIps
+	pMsg.DenyIps = cfg.DenyIps
 }
 
 // Bind info
@@ -153,8 +192,8 @@ type BindInfoConf struct {
 }
 
 func (cfg *BindInfoConf) LoadFromMsg(pMsg *msg.NewProxy) {
-	if ServerCommonCfg != nil {
-		cfg.BindAddr = ServerCommonCfg.BindAddr
+	if svrCfg := GetServerCommonCfg(); svrCfg != nil {
+		cfg.BindAddr = svrCfg.BindAddr
 	}
 
 	cfg.RemotePort = pMsg.RemotePort
@@ -181,8 +220,9 @@ func (cfg *BindInfoConf) UnMarshalToMsg(pMsg *msg.NewProxy) {
 
 func (cfg *BindInfoConf) check() (err error) {
 
-	if ServerCommonCfg != nil && cfg.RemotePort != 0 && len(ServerCommonCfg.PrivilegeAllowPorts) != 0 {
-		if ok := util.ContainsPort(ServerCommonCfg.PrivilegeAllowPorts, cfg.RemotePort); !ok {
+	svrCfg := GetServerCommonCfg()
+	if svrCfg != nil && cfg.RemotePort != 0 && len(svrCfg.PrivilegeAllowPorts) != 0 {
+		if ok := util.ContainsPort(svrCfg.PrivilegeAllowPorts, cfg.RemotePort); !ok {
 			return fmt.Errorf("remote port [%d] isn't allowed", cfg.RemotePort)
 		}
 	}
@@ -237,16 +277,17 @@ func (cfg *DomainConf) UnMarshalToMsg(pMsg *msg.NewProxy) {
 }
 
 func (cfg *DomainConf) check() (err error) {
+	subDomainHost := GetServerCommonCfg().SubDomainHost
 	for _, domain := range cfg.CustomDomains {
-		if ServerCommonCfg.SubDomainHost != "" && len(strings.Split(ServerCommonCfg.SubDomainHost, ".")) < len(strings.Split(domain, ".")) {
-			if strings.Contains(domain, ServerCommonCfg.SubDomainHost) {
-				return fmt.Errorf("custom domain [%s] should not belong to subdomain_host [%s]", domain, ServerCommonCfg.SubDomainHost)
+		if subDomainHost != "" && len(strings.Split(subDomainHost, ".")) < len(strings.Split(domain, ".")) {
+			if strings.Contains(domain, subDomainHost) {
+				return fmt.Errorf("custom domain [%s] should not belong to subdomain_host [%s]", domain, subDomainHost)
 			}
 		}
 	}
 
 	if cfg.SubDomain != "" {
-		if ServerCommonCfg.SubDomainHost == "" {
+		if subDomainHost == "" {
 			return fmt.Errorf("subdomain is not supported because this feature is not enabled by frps")
 		}
 		if strings.Contains(cfg.SubDomain, ".") || strings.Contains(cfg.SubDomain, "*") {
@@ -528,7 +569,7 @@ func (cfg *HttpProxyConf) UnMarshalToMsg(pMsg *msg.NewProxy) {
 }
 
 func (cfg *HttpProxyConf) Check() (err error) {
-	if ServerCommonCfg.VhostHttpPort == 0 {
+	if GetServerCommonCfg().VhostHttpPort == 0 {
 		return fmt.Errorf("type [http] not support when vhost_http_port is not set")
 	}
 	err = cfg.DomainConf.check()
@@ -576,7 +617,7 @@ func (cfg *HttpsProxyConf) UnMarshalToMsg(pMsg *msg.NewProxy) {
 }
 
 func (cfg *HttpsProxyConf) Check() (err error) {
-	if ServerCommonCfg.VhostHttpsPort == 0 {
+	if GetServerCommonCfg().VhostHttpsPort == 0 {
 		return fmt.Errorf("type [https] not support when vhost_https_port is not set")
 	}
 	err = cfg.DomainConf.check()
@@ -0,0 +1,119 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+)
+
+// serverConfItem is one setting of ServerCommonConf which may be changed by reloading.
+type serverConfItem struct {
+	// name in ini file
+	name string
+	// field name of ServerCommonConf
+	field string
+	// if live is true, the setting can be changed without restarting xfrps
+	live bool
+}
+
+var serverConfItems = []serverConfItem{
+	{"privilege_allow_ports", "PrivilegeAllowPorts", true},
+	{"subdomain_host", "SubDomainHost", true},
+	{"dashboard_user", "DashboardUser", true},
+	{"dashboard_pwd", "DashboardPwd", true},
+	{"dashboard_allow_default_auth", "DashboardAllowDefaultAuth", true},
+	{"enable_prometheus", "EnablePrometheus", true},
+	{"prometheus_user", "PrometheusUser", true},
+	{"prometheus_pwd", "PrometheusPwd", true},
+	{"privilege_token", "PrivilegeToken", true},
+	{"authentication_timeout", "AuthTimeout", true},
+	{"heartbeat_timeout", "HeartBeatTimeout", true},
+	{"pool_adaptive", "PoolAdaptive", true},
+	{"auth_allow_global_token", "AuthAllowGlobalToken", true},
+	{"max_clients", "MaxClients", true},
+	{"max_proxies_per_client", "MaxProxiesPerClient", true},
+	{"max_conns_per_proxy", "MaxConnsPerProxy", true},
+	{"max_conns_per_ip", "MaxConnsPerIp", true},
+	{"allow_ips", "AllowIps", true},
+	{"deny_ips", "DenyIps", true},
+
+	{"bind_addr", "BindAddr", false},
+	// work connection pool of client is sized by it when the client logins
+	{"max_pool_count", "MaxPoolCount", false},
+	{"bind_port", "BindPort", false},
+	{"protocol", "Protocol", false},
+	{"kcp_bind_port", "KcpBindPort", false},
+	{"vhost_http_port", "VhostHttpPort", false},
+	{"vhost_https_port", "VhostHttpsPort", false},
+	{"dashboard_port", "DashboardPort", false},
+	{"dashboard_domain", "DashboardDomain", false},
+	{"dashboard_token_file", "DashboardTokenFile", false},
+	{"dashboard_tls_cert_file", "DashboardTlsCertFile", false},
+	{"dashboard_tls_key_file", "DashboardTlsKeyFile", false},
+	{"dashboard_tls_client_ca_file", "DashboardTlsClientCaFile", false},
+	{"assets_dir", "AssetsDir", false},
+	{"log_file", "LogFile", false},
+	{"log_level", "LogLevel", false},
+	{"log_format", "LogFormat", false},
+	{"log_max_days", "LogMaxDays", false},
+	{"log_max_size", "LogMaxSize", false},
+	{"log_max_files", "LogMaxFiles", false},
+	{"log_compress", "LogCompress", false},
+	{"privilege_mode", "PrivilegeMode", false},
+	{"tcp_mux", "TcpMux", false},
+	{"enable_websocket", "EnableWebsocket", false},
+	{"port_store_file", "PortStoreFile", false},
+	{"port_expire_days", "PortExpireDays", false},
+	{"ban_store_file", "BanStoreFile", false},
+	{"stats_store_file", "StatsStoreFile", false},
+	{"user_conn_log_file", "UserConnLogFile", false},
+	{"user_conn_log_max_size", "UserConnLogMaxSize", false},
+	{"user_conn_log_max_files", "UserConnLogMaxFiles", false},
+	{"auth_file", "AuthFile", false},
+	{"tls_cert_file", "TlsCertFile", false},
+	{"tls_key_file", "TlsKeyFile", false},
+	{"tls_trusted_ca_file", "TlsTrustedCaFile", false},
+	{"tls_only", "TlsOnly", false},
+	{"tls_verify_runid", "TlsVerifyRunId", false},
+	{"plugin", "HttpPlugins", false},
+	{"client_bandwidth_limit", "ClientBandwidthLimit", false},
+}
+
+// MergeServerCommonConf returns a copy of cfg, with settings which can be changed without restarting taken from newCfg.
+// changed is names of these settings, restartRequired is names of other changed settings which are not applied.
+func MergeServerCommonConf(cfg *ServerCommonConf, newCfg *ServerCommonConf) (merged *ServerCommonConf, changed []string, restartRequired []string) {
+	tmp := *cfg
+	merged = &tmp
+	changed = make([]string, 0)
+	restartRequired = make([]string, 0)
+
+	oldValue := reflect.ValueOf(cfg).Elem()
+	newValue := reflect.ValueOf(newCfg).Elem()
+	mergedValue := reflect.ValueOf(merged).Elem()
+	for _, item := range serverConfItems {
+		o := oldValue.FieldByName(item.field)
+		n := newValue.FieldByName(item.field)
+		if reflect.DeepEqual(o.Interface(), n.Interface()) {
+			continue
+		}
+		if item.live {
+			mergedValue.FieldByName(item.field).Set(n)
+			changed = append(changed, item.name)
+		} else {
+			restartRequired = append(restartRequired, item.name)
+		}
+	}
+	return
+}
@@ -16,14 +16,32 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	plugin "github.com/liudf0716/xfrps/models/plugin/server"
+	"github.com/liudf0716/xfrps/utils/limit"
 	"github.com/liudf0716/xfrps/utils/util"
+
 	ini "github.com/vaughan0/go-ini"
 )
 
-var ServerCommonCfg *ServerCommonConf
+// serverCommonCfg keeps *ServerCommonConf, it's replaced as a whole when configures are reloaded
+// and never changed in place, so it's read by GetServerCommonCfg without locks.
+var serverCommonCfg atomic.Value
+
+// GetServerCommonCfg returns current configures of xfrps, nil if they are not loaded.
+func GetServerCommonCfg() *ServerCommonConf {
+	cfg, _ := serverCommonCfg.Load().(*ServerCommonConf)
+	return cfg
+}
+
+// SetServerCommonCfg replaces configures of xfrps, cfg must not be changed after that.
+func SetServerCommonCfg(cfg *ServerCommonConf) {
+	serverCommonCfg.Store(cfg)
+}
 
 // common config
 type ServerCommonConf struct {
@@ -37,7 +55,7 @@ type ServerCommonConf struct {
 	// if VhostHttpsPort equals 0, don't listen a public port for https protocol
 	VhostHttpsPort int64
 
-	// if DashboardPort equals 0, dashboard is not available
+	// dashboard listens on BindPort + 1 if dashboard_port is not set or 0
 	DashboardPort  int64
 	DashboardUser  string
 	DashboardPwd   string
@@ -45,22 +63,117 @@ type ServerCommonConf struct {
 	LogFile        string
 	LogWay         string // console or file
 	LogLevel       string
+	LogFormat      string // text or json
 	LogMaxDays     int64
+	LogMaxSize     int64
+	LogMaxFiles    int64
+	LogCompress    bool
 	PrivilegeMode  bool
 	PrivilegeToken string
 	AuthTimeout    int64
 	SubDomainHost  string
 	TcpMux         bool
 
+	// if EnableWebsocket is true, websocket requests for /~!frp on BindPort are accepted as connections from client
+	EnableWebsocket bool
+
 	// if PrivilegeAllowPorts is not nil, tcp proxies which remote port exist in this map can be connected
 	PrivilegeAllowPorts [][2]int64
 	MaxPoolCount        int64
 	HeartBeatTimeout    int64
 	UserConnTimeout     int64
 
+	// if PoolAdaptive is true, work connection pool of client grows when user connections wait for work connections,
+	// and shrinks back to client's pool_count when it's idle, never larger than MaxPoolCount
+	PoolAdaptive bool
+
 	// added by liudf
 	UseEncryption bool
 	UseCompressed bool
+
+	// if PortStoreFile is not empty, ports allocated for clients are saved in it and reloaded when xfrps restarts
+	PortStoreFile string
+
+	// ports of clients offline longer than PortExpireDays will be released, 0 means never
+	PortExpireDays int64
+
+	// if BanStoreFile is not empty, banned clients are saved in it and reloaded when xfrps restarts
+	BanStoreFile string
+
+	// if StatsStoreFile is not empty, statistics of traffic, proxies and clients are saved in it and reloaded when xfrps restarts
+	StatsStoreFile string
+
+	// if UserConnLogFile is not empty, a json line is written to it for every finished user connection,
+	// "syslog" means local syslog. The file is rotated when it's larger than UserConnLogMaxSize bytes,
+	// at most UserConnLogMaxFiles rotated files are kept
+	UserConnLogFile     string
+	UserConnLogMaxSize  int64
+	UserConnLogMaxFiles int64
+
+	// if AuthFile is not empty, clients found in it must login with their own tokens
+	AuthFile string
+
+	// if AuthAllowGlobalToken is true, clients not found in AuthFile can login with PrivilegeToken
+	AuthAllowGlobalToken bool
+
+	// http plugins called on login, new proxy and new user connection, indexed by plugin name
+	HttpPlugins map[string]plugin.HttpPluginOptions
+
+	// if TlsCertFile and TlsKeyFile are not empty, clients can connect with TLS
+	TlsCertFile string
+	TlsKeyFile  string
+
+	// if TlsTrustedCaFile is not empty, clients connected with TLS must provide certificates signed by it
+	TlsTrustedCaFile string
+
+	// if TlsOnly is true, clients not using TLS are rejected
+	TlsOnly bool
+
+	// if TlsVerifyRunId is true, common name of client's certificate must be its RunId
+	TlsVerifyRunId bool
+
+	// if dashboard shares BindPort with VhostHttpPort or VhostHttpsPort,
+	// requests for DashboardDomain are sent to dashboard
+	DashboardDomain string
+
+	// if EnablePrometheus is true, dashboard serves metrics on /metrics,
+	// it's protected by PrometheusUser and PrometheusPwd, or dashboard's user and password if both are empty
+	EnablePrometheus bool
+	PrometheusUser   string
+	PrometheusPwd    string
+
+	// if DashboardTokenFile is not empty, dashboard api accepts tokens found in it besides DashboardUser and DashboardPwd
+	DashboardTokenFile string
+
+	// xfrps refuses to start with the default DashboardUser and DashboardPwd unless DashboardAllowDefaultAuth is true
+	DashboardAllowDefaultAuth bool
+
+	// if DashboardTlsCertFile is not empty, dashboard is served over https only, the certificate is reloaded when it's modified
+	DashboardTlsCertFile string
+	DashboardTlsKeyFile  string
+
+	// if DashboardTlsClientCaFile is not empty, client certificates signed by it can be used instead of tokens,
+	// the common name of certificate is the name of token in DashboardTokenFile
+	DashboardTlsClientCaFile string
+
+	// if Protocol is kcp, clients can connect with kcp on udp port KcpBindPort, besides tcp on BindPort
+	Protocol    string
+	KcpBindPort int64
+
+	// bytes per second of every client in each direction, shared by all proxies of the client, 0 means no limit
+	ClientBandwidthLimit int64
+
+	// quotas of clients and user connections, 0 means no limit.
+	// udp proxies have no connections, their packets aren't counted by MaxConnsPerProxy and MaxConnsPerIp
+	MaxClients          int64
+	MaxProxiesPerClient int64
+	MaxConnsPerProxy    int64
+	MaxConnsPerIp       int64
+
+	// source ips of user connections to all proxies, proxies can only narrow them by their own allow_ips and deny_ips
+	// empty AllowIps means all
+	AllowIps []*net.IPNet
+	DenyIps  []*net.IPNet
 }
 
 func GetDefaultServerCommonConf() *ServerCommonConf {
@@ -77,17 +190,33 @@ func GetDefaultServerCommonConf() *ServerCommonConf {
 		LogFile:          "console",
 		LogWay:           "console",
 		LogLevel:         "info",
+		LogFormat:        "text",
 		LogMaxDays:       3,
+		LogMaxSize:       0,
+		LogMaxFiles:      10,
+		LogCompress:      false,
 		PrivilegeMode:    true,
 		PrivilegeToken:   "",
 		AuthTimeout:      900,
 		SubDomainHost:    "",
 		TcpMux:           false,
 		MaxPoolCount:     5,
+		PoolAdaptive:     true,
 		HeartBeatTimeout: 90,
 		UserConnTimeout:  10,
 		UseEncryption:    false,
 		UseCompressed:    false,
+		PortStoreFile:    "",
+		PortExpireDays:   0,
+
+		UserConnLogMaxSize:  100 * 1024 * 1024,
+		UserConnLogMaxFiles: 10,
+
+		AuthFile:             "",
+		AuthAllowGlobalToken: true,
+		HttpPlugins:          make(map[string]plugin.HttpPluginOptions),
+		Protocol:             "tcp",
+		KcpBindPort:          0,
 	}
 }
 
@@ -113,6 +242,26 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		}
 	}
 
+	tmpStr, ok = conf.Get("common", "protocol")
+	if ok {
+		if tmpStr != "tcp" && tmpStr != "kcp" {
+			err = fmt.Errorf("Parse conf error: protocol should be tcp or kcp")
+			return
+		}
+		cfg.Protocol = tmpStr
+	}
+
+	// kcp listens on udp, so it can use the same port number as bind_port
+	cfg.KcpBindPort = cfg.BindPort
+	tmpStr, ok = conf.Get("common", "kcp_bind_port")
+	if ok {
+		cfg.KcpBindPort, err = strconv.ParseInt(tmpStr, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Parse conf error: kcp_bind_port is incorrect")
+			return
+		}
+	}
+
 	tmpStr, ok = conf.Get("common", "vhost_http_port")
 	if ok {
 		cfg.VhostHttpPort, err = strconv.ParseInt(tmpStr, 10, 64)
@@ -142,8 +291,14 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 			err = fmt.Errorf("Parse conf error: dashboard_port is incorrect")
 			return
 		}
-	} else {
-		cfg.DashboardPort = 0
+	}
+	if cfg.DashboardPort == 0 {
+		cfg.DashboardPort = cfg.BindPort + 1
+	}
+
+	tmpStr, ok = conf.Get("common", "dashboard_domain")
+	if ok {
+		cfg.DashboardDomain = tmpStr
 	}
 
 	tmpStr, ok = conf.Get("common", "dashboard_user")
@@ -156,6 +311,46 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		cfg.DashboardPwd = tmpStr
 	}
 
+	tmpStr, ok = conf.Get("common", "dashboard_token_file")
+	if ok {
+		cfg.DashboardTokenFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "dashboard_allow_default_auth")
+	if ok && tmpStr == "true" {
+		cfg.DashboardAllowDefaultAuth = true
+	}
+
+	tmpStr, ok = conf.Get("common", "dashboard_tls_cert_file")
+	if ok {
+		cfg.DashboardTlsCertFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "dashboard_tls_key_file")
+	if ok {
+		cfg.DashboardTlsKeyFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "dashboard_tls_client_ca_file")
+	if ok {
+		cfg.DashboardTlsClientCaFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "enable_prometheus")
+	if ok && tmpStr == "true" {
+		cfg.EnablePrometheus = true
+	}
+
+	tmpStr, ok = conf.Get("common", "prometheus_user")
+	if ok {
+		cfg.PrometheusUser = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "prometheus_pwd")
+	if ok {
+		cfg.PrometheusPwd = tmpStr
+	}
+
 	tmpStr, ok = conf.Get("common", "assets_dir")
 	if ok {
 		cfg.AssetsDir = tmpStr
@@ -176,6 +371,15 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		cfg.LogLevel = tmpStr
 	}
 
+	tmpStr, ok = conf.Get("common", "log_format")
+	if ok {
+		if tmpStr != "text" && tmpStr != "json" {
+			err = fmt.Errorf("Parse conf error: log_format should be text or json")
+			return
+		}
+		cfg.LogFormat = tmpStr
+	}
+
 	tmpStr, ok = conf.Get("common", "log_max_days")
 	if ok {
 		v, err = strconv.ParseInt(tmpStr, 10, 64)
@@ -184,6 +388,27 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		}
 	}
 
+	tmpStr, ok = conf.Get("common", "log_max_size")
+	if ok {
+		if cfg.LogMaxSize, err = util.ParseSize(tmpStr); err != nil {
+			err = fmt.Errorf("Parse conf error: log_max_size is incorrect")
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "log_max_files")
+	if ok {
+		if cfg.LogMaxFiles, err = strconv.ParseInt(tmpStr, 10, 64); err != nil || cfg.LogMaxFiles < 0 {
+			err = fmt.Errorf("Parse conf error: log_max_files is incorrect")
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "log_compress")
+	if ok && tmpStr == "true" {
+		cfg.LogCompress = true
+	}
+
 	tmpStr, ok = conf.Get("common", "privilege_mode")
 	if ok {
 		if tmpStr == "true" {
@@ -214,6 +439,58 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		}
 	}
 
+	tmpStr, ok = conf.Get("common", "pool_adaptive")
+	if ok && tmpStr == "false" {
+		cfg.PoolAdaptive = false
+	}
+
+	tmpStr, ok = conf.Get("common", "client_bandwidth_limit")
+	if ok {
+		cfg.ClientBandwidthLimit, err = limit.ParseBandwidth(tmpStr)
+		if err != nil {
+			err = fmt.Errorf("Parse conf error: client_bandwidth_limit is incorrect, %v", err)
+			return
+		}
+	}
+
+	for _, quota := range []struct {
+		name  string
+		value *int64
+	}{
+		{"max_clients", &cfg.MaxClients},
+		{"max_proxies_per_client", &cfg.MaxProxiesPerClient},
+		{"max_conns_per_proxy", &cfg.MaxConnsPerProxy},
+		{"max_conns_per_ip", &cfg.MaxConnsPerIp},
+	} {
+		tmpStr, ok = conf.Get("common", quota.name)
+		if ok {
+			v, errRet := strconv.ParseInt(tmpStr, 10, 64)
+			if errRet != nil || v < 0 {
+				err = fmt.Errorf("Parse conf error: %s is incorrect", quota.name)
+				return
+			}
+			*quota.value = v
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "allow_ips")
+	if ok {
+		cfg.AllowIps, err = util.GetIpNets(tmpStr)
+		if err != nil {
+			err = fmt.Errorf("Parse conf error: allow_ips is incorrect, %v", err)
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "deny_ips")
+	if ok {
+		cfg.DenyIps, err = util.GetIpNets(tmpStr)
+		if err != nil {
+			err = fmt.Errorf("Parse conf error: deny_ips is incorrect, %v", err)
+			return
+		}
+	}
+
 	tmpStr, ok = conf.Get("common", "authentication_timeout")
 	if ok {
 		v, errRet := strconv.ParseInt(tmpStr, 10, 64)
@@ -237,6 +514,11 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 		cfg.TcpMux = false
 	}
 
+	tmpStr, ok = conf.Get("common", "enable_websocket")
+	if ok && tmpStr == "true" {
+		cfg.EnableWebsocket = true
+	}
+
 	tmpStr, ok = conf.Get("common", "heartbeat_timeout")
 	if ok {
 		v, errRet := strconv.ParseInt(tmpStr, 10, 64)
@@ -247,5 +529,166 @@ func LoadServerCommonConf(conf ini.File) (cfg *ServerCommonConf, err error) {
 			cfg.HeartBeatTimeout = v
 		}
 	}
+
+	tmpStr, ok = conf.Get("common", "port_store_file")
+	if ok {
+		cfg.PortStoreFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "port_expire_days")
+	if ok {
+		v, errRet := strconv.ParseInt(tmpStr, 10, 64)
+		if errRet != nil || v < 0 {
+			err = fmt.Errorf("Parse conf error: port_expire_days is incorrect")
+			return
+		} else {
+			cfg.PortExpireDays = v
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "ban_store_file")
+	if ok {
+		cfg.BanStoreFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "stats_store_file")
+	if ok {
+		cfg.StatsStoreFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "user_conn_log_file")
+	if ok {
+		cfg.UserConnLogFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "user_conn_log_max_size")
+	if ok {
+		if cfg.UserConnLogMaxSize, err = util.ParseSize(tmpStr); err != nil {
+			err = fmt.Errorf("Parse conf error: user_conn_log_max_size is incorrect")
+			return
+		}
+	}
+
+	tmpStr, ok = conf.Get("common", "user_conn_log_max_files")
+	if ok {
+		v, err = strconv.ParseInt(tmpStr, 10, 64)
+		if err != nil || v < 0 {
+			err = fmt.Errorf("Parse conf error: user_conn_log_max_files is incorrect")
+			return
+		}
+		cfg.UserConnLogMaxFiles = v
+	}
+
+	tmpStr, ok = conf.Get("common", "auth_file")
+	if ok {
+		cfg.AuthFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "auth_allow_global_token")
+	if ok && tmpStr == "false" {
+		cfg.AuthAllowGlobalToken = false
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_cert_file")
+	if ok {
+		cfg.TlsCertFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_key_file")
+	if ok {
+		cfg.TlsKeyFile = tmpStr
+	}
+
+	if (cfg.TlsCertFile == "") != (cfg.TlsKeyFile == "") {
+		err = fmt.Errorf("Parse conf error: tls_cert_file and tls_key_file must be set together")
+		return
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_trusted_ca_file")
+	if ok {
+		cfg.TlsTrustedCaFile = tmpStr
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_only")
+	if ok && tmpStr == "true" {
+		cfg.TlsOnly = true
+	}
+
+	tmpStr, ok = conf.Get("common", "tls_verify_runid")
+	if ok && tmpStr == "true" {
+		cfg.TlsVerifyRunId = true
+	}
+
+	if cfg.TlsCertFile == "" && (cfg.TlsOnly || cfg.TlsTrustedCaFile != "") {
+		err = fmt.Errorf("Parse conf error: tls_cert_file is required by tls_only and tls_trusted_ca_file")
+		return
+	}
+	if cfg.TlsVerifyRunId && cfg.TlsTrustedCaFile == "" {
+		err = fmt.Errorf("Parse conf error: tls_verify_runid requires tls_trusted_ca_file")
+		return
+	}
+
+	// dashboard is always served
+	if !cfg.DashboardAllowDefaultAuth && cfg.DashboardUser == "admin" && cfg.DashboardPwd == "admin" {
+		err = fmt.Errorf("Parse conf error: default dashboard_user and dashboard_pwd are not allowed, change them or set dashboard_allow_default_auth = true")
+		return
+	}
+
+	if (cfg.DashboardTlsCertFile == "") != (cfg.DashboardTlsKeyFile == "") {
+		err = fmt.Errorf("Parse conf error: dashboard_tls_cert_file and dashboard_tls_key_file must be set together")
+		return
+	}
+	if cfg.DashboardTlsClientCaFile != "" && (cfg.DashboardTlsCertFile == "" || cfg.DashboardTokenFile == "") {
+		err = fmt.Errorf("Parse conf error: dashboard_tls_client_ca_file requires dashboard_tls_cert_file and dashboard_token_file")
+		return
+	}
+
+	// dashboard serves http unless its own certificate is set, and serves https if any certificate is set
+	dashboardHttp := cfg.DashboardTlsCertFile == ""
+	dashboardHttps := cfg.DashboardTlsCertFile != "" || cfg.TlsCertFile != ""
+	if cfg.DashboardPort == cfg.BindPort && cfg.DashboardDomain == "" &&
+		((cfg.VhostHttpPort == cfg.BindPort && dashboardHttp) || (cfg.VhostHttpsPort == cfg.BindPort && dashboardHttps)) {
+		err = fmt.Errorf("Parse conf error: dashboard_domain is required when dashboard shares bind_port with vhost")
+		return
+	}
+
+	cfg.HttpPlugins, err = loadHttpPluginOptions(conf)
+	return
+}
+
+// loadHttpPluginOptions loads plugins from sections like:
+//
+//	[plugin.user-manager]
+//	addr = 127.0.0.1:9000
+//	path = /handler
+//	ops = Login,NewProxy
+func loadHttpPluginOptions(conf ini.File) (plugins map[string]plugin.HttpPluginOptions, err error) {
+	plugins = make(map[string]plugin.HttpPluginOptions)
+	for name, section := range conf {
+		if !strings.HasPrefix(name, "plugin.") {
+			continue
+		}
+		options := plugin.HttpPluginOptions{
+			Name: strings.TrimPrefix(name, "plugin."),
+			Addr: section["addr"],
+			Path: section["path"],
+		}
+		if options.Addr == "" {
+			err = fmt.Errorf("Parse conf error: addr of plugin [%s] is incorrect", options.Name)
+			return
+		}
+		for _, op := range strings.Split(section["ops"], ",") {
+			op = strings.TrimSpace(op)
+			switch op {
+			case plugin.OpLogin, plugin.OpNewProxy, plugin.OpNewUserConn:
+				options.Ops = append(options.Ops, op)
+			case "":
+			default:
+				err = fmt.Errorf("Parse conf error: ops [%s] of plugin [%s] is incorrect", op, options.Name)
+				return
+			}
+		}
+		plugins[options.Name] = options
+	}
 	return
 }
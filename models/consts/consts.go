@@ -28,4 +28,7 @@ var (
 	HttpProxy  string = "http"
 	HttpsProxy string = "https"
 	FtpProxy   string = "ftp"
+
+	// name suffix of the tcp proxy created for ftp data connections
+	FtpDataProxySuffix string = "_ftp_data_proxy"
 )
@@ -24,6 +24,7 @@ const (
 	TypeLoginResp     = '1'
 	TypeNewProxy      = 'p'
 	TypeNewProxyResp  = '2'
+	TypeCloseProxy    = 'c'
 	TypeNewWorkConn   = 'w'
 	TypeReqWorkConn   = 'r'
 	TypeStartWorkConn = 's'
@@ -45,6 +46,7 @@ func init() {
 	TypeMap[TypeLoginResp] = reflect.TypeOf(LoginResp{})
 	TypeMap[TypeNewProxy] = reflect.TypeOf(NewProxy{})
 	TypeMap[TypeNewProxyResp] = reflect.TypeOf(NewProxyResp{})
+	TypeMap[TypeCloseProxy] = reflect.TypeOf(CloseProxy{})
 	TypeMap[TypeNewWorkConn] = reflect.TypeOf(NewWorkConn{})
 	TypeMap[TypeReqWorkConn] = reflect.TypeOf(ReqWorkConn{})
 	TypeMap[TypeStartWorkConn] = reflect.TypeOf(StartWorkConn{})
@@ -89,6 +91,13 @@ type NewProxy struct {
 	UseEncryption  bool   `json:"use_encryption"`
 	UseCompression bool   `json:"use_compression"`
 
+	// bytes per second in each direction, like 512KB or 2MB, empty means no limit
+	BandwidthLimit string `json:"bandwidth_limit"`
+
+	// source ips of user connections like 192.168.1.0/24, empty AllowIps means all
+	AllowIps []string `json:"allow_ips"`
+	DenyIps  []string `json:"deny_ips"`
+
 	// tcp and udp only
 	RemotePort int64 `json:"remote_port"`
 
@@ -114,6 +123,15 @@ type NewProxyResp struct {
 	RemotePort int64 `json:"remote_port"`
 }
 
+// CloseProxy removes one proxy without reconnecting.
+// Client sends it to withdraw a proxy, server sends it to revoke a proxy with the reason.
+// If RemotePort is not 0, the proxy's port is changed by server and client registers it again with RemotePort.
+type CloseProxy struct {
+	ProxyName  string `json:"proxy_name"`
+	Reason     string `json:"reason"`
+	RemotePort int64  `json:"remote_port"`
+}
+
 type NewWorkConn struct {
 	RunId string `json:"run_id"`
 }
@@ -0,0 +1,129 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+const (
+	httpPluginTimeout = 10 * time.Second
+)
+
+type HttpPluginOptions struct {
+	Name string
+	Addr string
+	Path string
+	Ops  []string
+}
+
+// HttpPlugin sends operations as json to a http server.
+type HttpPlugin struct {
+	options HttpPluginOptions
+
+	url    string
+	client *http.Client
+}
+
+func NewHttpPlugin(options HttpPluginOptions) Plugin {
+	return &HttpPlugin{
+		options: options,
+		url:     fmt.Sprintf("http://%s%s", options.Addr, options.Path),
+		client: &http.Client{
+			Timeout: httpPluginTimeout,
+		},
+	}
+}
+
+func (p *HttpPlugin) Name() string {
+	return p.options.Name
+}
+
+func (p *HttpPlugin) IsSupport(op string) bool {
+	for _, v := range p.options.Ops {
+		if v == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HttpPlugin) Handle(op string, content interface{}) (*Response, interface{}, error) {
+	r := &Request{
+		Version: APIVersion,
+		Op:      op,
+		Content: content,
+	}
+	var res struct {
+		Response
+		Content json.RawMessage `json:"content"`
+	}
+	err := p.do(r, &res)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a response without content changes nothing
+	if len(res.Content) == 0 || string(res.Content) == "null" {
+		res.Unchange = true
+	}
+	if res.Reject || res.Unchange {
+		return &res.Response, nil, nil
+	}
+	// decode new content into the same type as the request content
+	newContent := reflect.New(reflect.TypeOf(content).Elem()).Interface()
+	if err = json.Unmarshal(res.Content, newContent); err != nil {
+		return nil, nil, err
+	}
+	res.Response.Content = newContent
+	return &res.Response, newContent, nil
+}
+
+func (p *HttpPlugin) do(r *Request, res interface{}) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Set("version", r.Version)
+	v.Set("op", r.Op)
+	req, err := http.NewRequest("POST", p.url+"?"+v.Encode(), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("do http request error code: %d", resp.StatusCode)
+	}
+	buf, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, res)
+}
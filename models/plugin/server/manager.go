@@ -0,0 +1,104 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/liudf0716/xfrps/utils/log"
+)
+
+// Manager calls all plugins registered for an operation in order.
+// The content changed by one plugin is passed to the next one.
+type Manager struct {
+	loginPlugins       []Plugin
+	newProxyPlugins    []Plugin
+	newUserConnPlugins []Plugin
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		loginPlugins:       make([]Plugin, 0),
+		newProxyPlugins:    make([]Plugin, 0),
+		newUserConnPlugins: make([]Plugin, 0),
+	}
+}
+
+func (m *Manager) Register(p Plugin) {
+	if p.IsSupport(OpLogin) {
+		m.loginPlugins = append(m.loginPlugins, p)
+	}
+	if p.IsSupport(OpNewProxy) {
+		m.newProxyPlugins = append(m.newProxyPlugins, p)
+	}
+	if p.IsSupport(OpNewUserConn) {
+		m.newUserConnPlugins = append(m.newUserConnPlugins, p)
+	}
+}
+
+// IsSupport returns true if any plugin is registered for op.
+func (m *Manager) IsSupport(op string) bool {
+	switch op {
+	case OpLogin:
+		return len(m.loginPlugins) > 0
+	case OpNewProxy:
+		return len(m.newProxyPlugins) > 0
+	case OpNewUserConn:
+		return len(m.newUserConnPlugins) > 0
+	}
+	return false
+}
+
+func (m *Manager) Login(content *LoginContent) (*LoginContent, error) {
+	newContent, err := m.handle(m.loginPlugins, OpLogin, content)
+	if err != nil {
+		return nil, err
+	}
+	return newContent.(*LoginContent), nil
+}
+
+func (m *Manager) NewProxy(content *NewProxyContent) (*NewProxyContent, error) {
+	newContent, err := m.handle(m.newProxyPlugins, OpNewProxy, content)
+	if err != nil {
+		return nil, err
+	}
+	return newContent.(*NewProxyContent), nil
+}
+
+func (m *Manager) NewUserConn(content *NewUserConnContent) (*NewUserConnContent, error) {
+	newContent, err := m.handle(m.newUserConnPlugins, OpNewUserConn, content)
+	if err != nil {
+		return nil, err
+	}
+	return newContent.(*NewUserConnContent), nil
+}
+
+// handle returns an error if any plugin rejects the operation or can't be reached.
+func (m *Manager) handle(plugins []Plugin, op string, content interface{}) (interface{}, error) {
+	for _, p := range plugins {
+		res, newContent, err := p.Handle(op, content)
+		if err != nil {
+			log.Warn("send %s request to plugin [%s] error: %v", op, p.Name(), err)
+			return nil, fmt.Errorf("send %s request to plugin error", op)
+		}
+		if res.Reject {
+			return nil, fmt.Errorf("%s", res.RejectReason)
+		}
+		if !res.Unchange {
+			content = newContent
+		}
+	}
+	return content, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/liudf0716/xfrps/models/msg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPlugin(t *testing.T, ops []string, handler func(r *Request, content json.RawMessage) *Response) (*httptest.Server, Plugin) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r struct {
+			Request
+			Content json.RawMessage `json:"content"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, r.Op, req.URL.Query().Get("op"))
+		json.NewEncoder(w).Encode(handler(&r.Request, r.Content))
+	}))
+	p := NewHttpPlugin(HttpPluginOptions{
+		Name: "test",
+		Addr: strings.TrimPrefix(ts.URL, "http://"),
+		Path: "/handler",
+		Ops:  ops,
+	})
+	return ts, p
+}
+
+func TestManagerLoginReject(t *testing.T) {
+	assert := assert.New(t)
+
+	ts, p := newTestPlugin(t, []string{OpLogin}, func(r *Request, content json.RawMessage) *Response {
+		var c LoginContent
+		json.Unmarshal(content, &c)
+		if c.RunId == "bad" {
+			return &Response{Reject: true, RejectReason: "runid is banned"}
+		}
+		return &Response{Unchange: true}
+	})
+	defer ts.Close()
+
+	m := NewManager()
+	m.Register(p)
+
+	_, err := m.Login(&LoginContent{Login: msg.Login{RunId: "bad"}})
+	assert.EqualError(err, "runid is banned")
+
+	res, err := m.Login(&LoginContent{Login: msg.Login{RunId: "good"}})
+	assert.NoError(err)
+	assert.Equal("good", res.RunId)
+}
+
+func TestManagerNewProxyRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	ts, p := newTestPlugin(t, []string{OpNewProxy}, func(r *Request, content json.RawMessage) *Response {
+		var c NewProxyContent
+		json.Unmarshal(content, &c)
+		c.SubDomain = c.User.RunId
+		c.RemotePort = 0
+		return &Response{Content: c}
+	})
+	defer ts.Close()
+
+	m := NewManager()
+	m.Register(p)
+
+	res, err := m.NewProxy(&NewProxyContent{
+		User:     UserInfo{RunId: "abc"},
+		NewProxy: msg.NewProxy{ProxyName: "web", SubDomain: "other", RemotePort: 80},
+	})
+	assert.NoError(err)
+	assert.Equal("web", res.ProxyName)
+	assert.Equal("abc", res.SubDomain)
+	assert.EqualValues(0, res.RemotePort)
+
+	// ops not registered are not sent to plugin
+	_, err = m.NewUserConn(&NewUserConnContent{ProxyName: "web"})
+	assert.NoError(err)
+}
+
+func TestManagerPluginUnreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	ts, p := newTestPlugin(t, []string{OpNewUserConn}, nil)
+	ts.Close()
+
+	m := NewManager()
+	m.Register(p)
+	_, err := m.NewUserConn(&NewUserConnContent{ProxyName: "web"})
+	assert.Error(err)
+}
+
+func TestManagerEmptyContent(t *testing.T) {
+	assert := assert.New(t)
+
+	// neither unchange nor content is set
+	ts, p := newTestPlugin(t, []string{OpLogin}, func(r *Request, content json.RawMessage) *Response {
+		return &Response{}
+	})
+	defer ts.Close()
+
+	m := NewManager()
+	m.Register(p)
+	assert.True(m.IsSupport(OpLogin))
+	assert.False(m.IsSupport(OpNewUserConn))
+
+	res, err := m.Login(&LoginContent{Login: msg.Login{RunId: "good", User: "alice"}})
+	assert.NoError(err)
+	assert.Equal("good", res.RunId)
+	assert.Equal("alice", res.User)
+}
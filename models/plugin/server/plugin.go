@@ -0,0 +1,34 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+const (
+	APIVersion = "0.1.0"
+
+	OpLogin       = "Login"
+	OpNewProxy    = "NewProxy"
+	OpNewUserConn = "NewUserConn"
+)
+
+// Plugin is called by xfrps on some operations,
+// it can reject the operation or change its content.
+type Plugin interface {
+	Name() string
+	IsSupport(op string) bool
+
+	// Handle returns the response and the new content decoded into the type of content.
+	// A response without content is unchanged, newContent is nil if it's rejected or unchanged.
+	Handle(op string, content interface{}) (res *Response, newContent interface{}, err error)
+}
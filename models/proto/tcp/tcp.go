@@ -27,11 +27,19 @@ func WithEncryption(rwc io.ReadWriteCloser, key []byte) (io.ReadWriteCloser, err
 	if err != nil {
 		return nil, err
 	}
-	return WrapReadWriteCloser(crypto.NewReader(rwc, key), w), nil
+	return &ReadWriteCloser{
+		r:      crypto.NewReader(rwc, key),
+		w:      w,
+		closer: rwc,
+	}, nil
 }
 
 func WithCompression(rwc io.ReadWriteCloser) io.ReadWriteCloser {
-	return WrapReadWriteCloser(snappy.NewReader(rwc), snappy.NewWriter(rwc))
+	return &ReadWriteCloser{
+		r:      snappy.NewReader(rwc),
+		w:      snappy.NewWriter(rwc),
+		closer: rwc,
+	}
 }
 
 func WrapReadWriteCloser(r io.Reader, w io.Writer) io.ReadWriteCloser {
@@ -44,6 +52,9 @@ func WrapReadWriteCloser(r io.Reader, w io.Writer) io.ReadWriteCloser {
 type ReadWriteCloser struct {
 	r io.Reader
 	w io.Writer
+
+	// the wrapped connection closed at last, nil if there is nothing to close
+	closer io.Closer
 }
 
 func (rwc *ReadWriteCloser) Read(p []byte) (n int, err error) {
@@ -69,5 +80,12 @@ func (rwc *ReadWriteCloser) Close() (errRet error) {
 			errRet = err
 		}
 	}
+
+	if rwc.closer != nil {
+		err = rwc.closer.Close()
+		if err != nil {
+			errRet = err
+		}
+	}
 	return
 }
@@ -98,3 +98,19 @@ func TestWithEncryption(t *testing.T) {
 	n, err = conn1.Read(buf)
 	assert.NoError(err)
 }
+
+func TestCloseWrappedConn(t *testing.T) {
+	assert := assert.New(t)
+
+	pr, pw := io.Pipe()
+	conn := WrapReadWriteCloser(pr, pw)
+	encryptStream, err := WithEncryption(conn, []byte("123456"))
+	assert.NoError(err)
+	compressionStream := WithCompression(encryptStream)
+
+	compressionStream.Close()
+	_, err = pw.Write([]byte("1234"))
+	assert.Equal(io.ErrClosedPipe, err)
+	_, err = pr.Read(make([]byte, 4))
+	assert.Equal(io.ErrClosedPipe, err)
+}
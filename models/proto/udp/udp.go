@@ -38,7 +38,11 @@ func GetContent(m *msg.UdpPacket) (buf []byte, err error) {
 	return
 }
 
-func ForwardUserConn(udpConn *net.UDPConn, readCh <-chan *msg.UdpPacket, sendCh chan<- *msg.UdpPacket) {
+// ForwardUserConn sends packets from users to sendCh and packets in readCh back to users.
+// Packets are dropped if accept isn't nil and it returns false for their source address.
+func ForwardUserConn(udpConn *net.UDPConn, readCh <-chan *msg.UdpPacket, sendCh chan<- *msg.UdpPacket,
+	accept func(*net.UDPAddr) bool) {
+
 	// read
 	go func() {
 		for udpMsg := range readCh {
@@ -59,6 +63,9 @@ func ForwardUserConn(udpConn *net.UDPConn, readCh <-chan *msg.UdpPacket, sendCh
 			udpConn.Close()
 			return
 		}
+		if accept != nil && !accept(remoteAddr) {
+			continue
+		}
 		// buf[:n] will be encoded to string, so the bytes can be reused
 		udpMsg := NewUdpPacket(buf[:n], nil, remoteAddr)
 		select {
@@ -0,0 +1,158 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/msg"
+	"github.com/liudf0716/xfrps/utils/log"
+	"github.com/liudf0716/xfrps/utils/util"
+
+	ini "github.com/vaughan0/go-ini"
+)
+
+// Credential is the secret of one client, identified by its run id or user.
+type Credential struct {
+	Token   string
+	Revoked bool
+}
+
+// CredentialStore looks up credentials of clients.
+type CredentialStore interface {
+	// Get returns the credential by run id or user, ok is false if it doesn't exist.
+	Get(id string) (cred *Credential, ok bool, err error)
+}
+
+// IniCredentialStore reads credentials from an ini file, each section is a client:
+//
+//	[run_id or user]
+//	token = secret_of_this_client
+//	revoked = false
+//
+// The file is reloaded when it's modified, so clients can be added or revoked without restarting xfrps.
+type IniCredentialStore struct {
+	path    string
+	modTime time.Time
+	creds   map[string]*Credential
+
+	mu sync.Mutex
+}
+
+func NewIniCredentialStore(path string) (s *IniCredentialStore, err error) {
+	s = &IniCredentialStore{
+		path:  path,
+		creds: make(map[string]*Credential),
+	}
+	err = s.reload()
+	return
+}
+
+func (s *IniCredentialStore) Get(id string) (cred *Credential, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.reload(); err != nil {
+		return
+	}
+	cred, ok = s.creds[id]
+	return
+}
+
+// reload must be called with s.mu locked.
+func (s *IniCredentialStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	conf, err := ini.LoadFile(s.path)
+	if err != nil {
+		return err
+	}
+	creds := make(map[string]*Credential)
+	for id, section := range conf {
+		if id == "" {
+			continue
+		}
+		creds[id] = &Credential{
+			Token:   section["token"],
+			Revoked: section["revoked"] == "true",
+		}
+	}
+	s.creds = creds
+	s.modTime = info.ModTime()
+	log.Info("load [%d] client credentials from [%s]", len(creds), s.path)
+	return nil
+}
+
+// authLogin checks login message and returns the token the client authorized with,
+// it's also used as the key of encryption.
+func (svr *Service) authLogin(loginMsg *msg.Login) (token string, err error) {
+	cfg := config.GetServerCommonCfg()
+	nowTime := time.Now().Unix()
+	if cfg.AuthTimeout != 0 && nowTime-loginMsg.Timestamp > cfg.AuthTimeout {
+		err = fmt.Errorf("authorization timeout")
+		return
+	}
+
+	token = cfg.PrivilegeToken
+	if svr.credStore != nil {
+		var (
+			cred *Credential
+			ok   bool
+		)
+		// client's own credential is found by its run id first, then by its user
+		for _, id := range []string{loginMsg.RunId, loginMsg.User} {
+			if id == "" {
+				continue
+			}
+			if cred, ok, err = svr.credStore.Get(id); err != nil {
+				log.Warn("get credential of [%s] error: %v", id, err)
+				err = fmt.Errorf("authorization failed")
+				return
+			}
+			if ok {
+				break
+			}
+		}
+
+		if ok {
+			if cred.Revoked {
+				err = fmt.Errorf("authorization revoked")
+				return
+			}
+			token = cred.Token
+		} else if !cfg.AuthAllowGlobalToken {
+			err = fmt.Errorf("authorization failed")
+			return
+		}
+	}
+
+	key := util.GetAuthKey(token, loginMsg.Timestamp)
+	if subtle.ConstantTimeCompare([]byte(key), []byte(loginMsg.PrivilegeKey)) != 1 {
+		err = fmt.Errorf("authorization failed")
+		return
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/msg"
+	"github.com/liudf0716/xfrps/utils/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockCredentialStore map[string]*Credential
+
+func (s mockCredentialStore) Get(id string) (cred *Credential, ok bool, err error) {
+	cred, ok = s[id]
+	return
+}
+
+func newLoginMsg(runId string, user string, token string) *msg.Login {
+	now := time.Now().Unix()
+	return &msg.Login{
+		RunId:        runId,
+		User:         user,
+		Timestamp:    now,
+		PrivilegeKey: util.GetAuthKey(token, now),
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.GetDefaultServerCommonConf()
+	cfg.PrivilegeToken = "global"
+	config.SetServerCommonCfg(cfg)
+
+	// only the global token without auth file
+	svr := &Service{}
+	token, err := svr.authLogin(newLoginMsg("abc", "", "global"))
+	assert.NoError(err)
+	assert.Equal("global", token)
+	_, err = svr.authLogin(newLoginMsg("abc", "", "wrong"))
+	assert.Error(err)
+
+	svr.credStore = mockCredentialStore{
+		"abc":   {Token: "abc_token"},
+		"alice": {Token: "alice_token"},
+		"lost":  {Token: "lost_token", Revoked: true},
+	}
+
+	// own token is found by run id first, then by user
+	token, err = svr.authLogin(newLoginMsg("abc", "alice", "abc_token"))
+	assert.NoError(err)
+	assert.Equal("abc_token", token)
+	_, err = svr.authLogin(newLoginMsg("abc", "", "global"))
+	assert.Error(err)
+	token, err = svr.authLogin(newLoginMsg("def", "alice", "alice_token"))
+	assert.NoError(err)
+	assert.Equal("alice_token", token)
+
+	_, err = svr.authLogin(newLoginMsg("lost", "", "lost_token"))
+	assert.EqualError(err, "authorization revoked")
+
+	// clients not in auth file login with the global token by default
+	token, err = svr.authLogin(newLoginMsg("new", "", "global"))
+	assert.NoError(err)
+	assert.Equal("global", token)
+
+	cfg.AuthAllowGlobalToken = false
+	_, err = svr.authLogin(newLoginMsg("new", "", "global"))
+	assert.Error(err)
+
+	// login message is too old
+	cfg.AuthAllowGlobalToken = true
+	cfg.AuthTimeout = 900
+	loginMsg := newLoginMsg("new", "", "global")
+	loginMsg.Timestamp -= 1000
+	loginMsg.PrivilegeKey = util.GetAuthKey("global", loginMsg.Timestamp)
+	_, err = svr.authLogin(loginMsg)
+	assert.EqualError(err, "authorization timeout")
+}
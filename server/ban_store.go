@@ -0,0 +1,84 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	BanStoreVersion = 1
+)
+
+// BanSnapshot is all banned clients kept by BanManager.
+type BanSnapshot struct {
+	Version int `json:"version"`
+
+	// ban reasons indexed by run id
+	Reasons map[string]string `json:"reasons"`
+}
+
+// BanStore saves banned clients so that they are still rejected after xfrps restarts.
+type BanStore interface {
+	Load() (*BanSnapshot, error)
+	Save(*BanSnapshot) error
+}
+
+// JsonBanStore keeps banned clients in a json file.
+type JsonBanStore struct {
+	path string
+}
+
+func NewJsonBanStore(path string) *JsonBanStore {
+	return &JsonBanStore{
+		path: path,
+	}
+}
+
+// Load returns an empty snapshot if the file doesn't exist yet.
+func (s *JsonBanStore) Load() (snapshot *BanSnapshot, err error) {
+	snapshot = &BanSnapshot{
+		Version: BanStoreVersion,
+		Reasons: make(map[string]string),
+	}
+
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(buf, snapshot); err != nil {
+		err = fmt.Errorf("parse ban store file [%s] error: %v", s.path, err)
+		return
+	}
+	if snapshot.Version != BanStoreVersion {
+		err = fmt.Errorf("ban store file [%s] version [%d] is not supported", s.path, snapshot.Version)
+		return
+	}
+	if snapshot.Reasons == nil {
+		snapshot.Reasons = make(map[string]string)
+	}
+	return
+}
+
+func (s *JsonBanStore) Save(snapshot *BanSnapshot) error {
+	return saveJsonFile(s.path, snapshot)
+}
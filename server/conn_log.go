@@ -0,0 +1,94 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/log"
+)
+
+// UserConnRecord is written to user connection log when a user connection is finished.
+type UserConnRecord struct {
+	ConnId     string `json:"conn_id"`
+	ProxyName  string `json:"proxy_name"`
+	ProxyType  string `json:"proxy_type"`
+	RunId      string `json:"run_id"`
+	User       string `json:"user,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+
+	// http and https only, host and path of the first request
+	Host string `json:"host,omitempty"`
+	Path string `json:"path,omitempty"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// milliseconds
+	Duration int64 `json:"duration"`
+
+	// bytes from user and bytes to user
+	TrafficIn  int64 `json:"traffic_in"`
+	TrafficOut int64 `json:"traffic_out"`
+}
+
+// ConnLogger records finished user connections for auditing.
+type ConnLogger interface {
+	Log(record *UserConnRecord)
+}
+
+// JsonConnLogger writes every record as a json line.
+type JsonConnLogger struct {
+	w io.Writer
+
+	mu sync.Mutex
+}
+
+// NewConnLogger writes to local syslog if path is "syslog", otherwise to a file rotated by maxSize.
+func NewConnLogger(path string, maxSize int64, maxFiles int) (ConnLogger, error) {
+	var (
+		w   io.Writer
+		err error
+	)
+	if path == "syslog" {
+		w, err = newSyslogWriter()
+	} else {
+		w, err = log.NewRotateWriter(path, maxSize, maxFiles, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &JsonConnLogger{
+		w: w,
+	}, nil
+}
+
+func (l *JsonConnLogger) Log(record *UserConnRecord) {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		log.Warn("marshal user connection record error: %v", err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	l.mu.Lock()
+	_, err = l.w.Write(buf)
+	l.mu.Unlock()
+	if err != nil {
+		log.Warn("write user connection log error: %v", err)
+	}
+}
@@ -23,11 +23,12 @@ import (
 	"github.com/liudf0716/xfrps/models/config"
 	"github.com/liudf0716/xfrps/models/consts"
 	"github.com/liudf0716/xfrps/models/msg"
+	plugin "github.com/liudf0716/xfrps/models/plugin/server"
 	"github.com/liudf0716/xfrps/utils/crypto"
 	"github.com/liudf0716/xfrps/utils/errors"
+	"github.com/liudf0716/xfrps/utils/limit"
 	"github.com/liudf0716/xfrps/utils/net"
 	"github.com/liudf0716/xfrps/utils/shutdown"
-	"github.com/liudf0716/xfrps/utils/util"
 	"github.com/liudf0716/xfrps/utils/version"
 )
 
@@ -38,6 +39,9 @@ type Control struct {
 	// login message
 	loginMsg *msg.Login
 
+	// token the client authorized with, also used as the key of encryption
+	authToken string
+
 	// control connection
 	conn net.Conn
 
@@ -47,15 +51,29 @@ type Control struct {
 	// read from this channel to get the next message sent by client
 	readCh chan (msg.Message)
 
+	// closed when the last NewProxy or CloseProxy message is handled, only used by manager.
+	// These messages are handled in order out of manager, because plugins may take a while.
+	proxyMsgDone chan struct{}
+
 	// work connections
 	workConnCh chan net.Conn
 
 	// proxies in one client
 	proxies []Proxy
 
-	// pool count
+	// pool count asked by client, no larger than max_pool_count
 	poolCount int
 
+	// current size of work connection pool, it grows from poolCount to max_pool_count if pool is adaptive
+	poolSize int
+
+	// user connections waited for work connections since last pool check
+	poolMisses int
+
+	// bandwidth shared by all proxies of this client, nil means no limit
+	inLimiter  *limit.Limiter
+	outLimiter *limit.Limiter
+
 	// last time got the Ping message
 	lastPing time.Time
 
@@ -75,16 +93,32 @@ type Control struct {
 	mu sync.RWMutex
 }
 
-func NewControl(svr *Service, ctlConn net.Conn, loginMsg *msg.Login) *Control {
+func NewControl(svr *Service, ctlConn net.Conn, loginMsg *msg.Login, authToken string) *Control {
+	cfg := config.GetServerCommonCfg()
+	maxPoolCount := int(cfg.MaxPoolCount)
+	poolCount := loginMsg.PoolCount
+	if poolCount > maxPoolCount {
+		poolCount = maxPoolCount
+	}
+	if poolCount < 0 {
+		poolCount = 0
+	}
+	proxyMsgDone := make(chan struct{})
+	close(proxyMsgDone)
 	return &Control{
 		svr:             svr,
 		conn:            ctlConn,
 		loginMsg:        loginMsg,
+		authToken:       authToken,
 		sendCh:          make(chan msg.Message, 10),
 		readCh:          make(chan msg.Message, 10),
-		workConnCh:      make(chan net.Conn, loginMsg.PoolCount+10),
+		proxyMsgDone:    proxyMsgDone,
+		workConnCh:      make(chan net.Conn, maxPoolCount+10),
 		proxies:         make([]Proxy, 0),
-		poolCount:       loginMsg.PoolCount,
+		poolCount:       poolCount,
+		poolSize:        poolCount,
+		inLimiter:       limit.NewLimiter(cfg.ClientBandwidthLimit),
+		outLimiter:      limit.NewLimiter(cfg.ClientBandwidthLimit),
 		lastPing:        time.Now(),
 		runId:           loginMsg.RunId,
 		status:          consts.Working,
@@ -95,28 +129,26 @@ func NewControl(svr *Service, ctlConn net.Conn, loginMsg *msg.Login) *Control {
 	}
 }
 
-// Get free port for client, every client has only one free port
-func (ctl *Control) GetFreePort() (port int64) {
-	var ok bool
-	port, ok = ctl.svr.portManager.GetById(ctl.runId)
-	if !ok {
-		port = int64(util.RandomTCPPort())
-		ctl.svr.portManager.Add(ctl.runId, port)
-	}
+// GetFreePort returns the port allocated for one proxy of client.
+// Every proxy keeps its port when client reconnects.
+func (ctl *Control) GetFreePort(proxyName string, proxyType string) (port int64, err error) {
+	return ctl.svr.portManager.Alloc(ctl.runId, proxyName, proxyType)
+}
 
+// AcquirePort marks remote port specified by client as used.
+// acquiredPort is 0 if there is nothing to release when proxy closed.
+func (ctl *Control) AcquirePort(port int64) (acquiredPort int64, err error) {
+	acquired, err := ctl.svr.portManager.Acquire(ctl.runId, port)
+	if acquired {
+		acquiredPort = port
+	}
 	return
 }
 
-// Get ftp port for ftp client
-func (ctl *Control) GetFtpPort() (port int64) {
-	var ok bool
-	port, ok = ctl.svr.portManager.GetFtpById(ctl.runId)
-	if !ok {
-		port = int64(util.RandomTCPPort())
-		ctl.svr.portManager.AddFtp(ctl.runId, port)
+func (ctl *Control) ReleasePort(port int64) {
+	if port != 0 {
+		ctl.svr.portManager.Release(port)
 	}
-
-	return
 }
 
 // Start send a login success message to client and start working.
@@ -127,6 +159,7 @@ func (ctl *Control) Start() {
 		Error:   "",
 	}
 	msg.WriteMsg(ctl.conn, loginRespMsg)
+	ctl.svr.portManager.Online(ctl.runId)
 
 	go ctl.writer()
 	for i := 0; i < ctl.poolCount; i++ {
@@ -165,7 +198,10 @@ func (ctl *Control) GetWorkConn() (workConn net.Conn, err error) {
 		}
 	}()
 
-	var ok bool
+	var (
+		ok   bool
+		grow bool
+	)
 	// get a work connection from the pool
 	select {
 	case workConn, ok = <-ctl.workConnCh:
@@ -174,7 +210,11 @@ func (ctl *Control) GetWorkConn() (workConn net.Conn, err error) {
 			return
 		}
 		ctl.conn.Debug("get work connection from pool")
+		StatsPoolHit(ctl.runId)
 	default:
+		StatsPoolMiss(ctl.runId)
+		grow = ctl.growPool()
+		start := time.Now()
 		// no work connections available in the poll, send message to frpc to get more
 		err = errors.PanicToError(func() {
 			ctl.sendCh <- &msg.ReqWorkConn{}
@@ -191,8 +231,9 @@ func (ctl *Control) GetWorkConn() (workConn net.Conn, err error) {
 				ctl.conn.Warn("no work connections avaiable, %v", err)
 				return
 			}
+			ctl.conn.Debug("wait [%v] for work connection", time.Since(start))
 
-		case <-time.After(time.Duration(config.ServerCommonCfg.UserConnTimeout) * time.Second):
+		case <-time.After(time.Duration(config.GetServerCommonCfg().UserConnTimeout) * time.Second):
 			err = fmt.Errorf("timeout trying to get work connection")
 			ctl.conn.Warn("%v", err)
 			return
@@ -200,18 +241,60 @@ func (ctl *Control) GetWorkConn() (workConn net.Conn, err error) {
 	}
 
 	// When we get a work connection from pool, replace it with a new one.
+	// One more is needed if the pool grows.
 	errors.PanicToError(func() {
 		ctl.sendCh <- &msg.ReqWorkConn{}
+		if grow {
+			ctl.sendCh <- &msg.ReqWorkConn{}
+		}
 	})
 	return
 }
 
+// growPool is called when a user connection has to wait for work connection,
+// returns true if pool is adaptive and not larger than max_pool_count yet.
+func (ctl *Control) growPool() (grow bool) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	ctl.poolMisses++
+	cfg := config.GetServerCommonCfg()
+	if cfg.PoolAdaptive && ctl.poolSize < int(cfg.MaxPoolCount) {
+		ctl.poolSize++
+		grow = true
+		ctl.conn.Debug("work connection pool grows to [%d]", ctl.poolSize)
+		StatsPoolSize(ctl.runId, ctl.poolSize)
+	}
+	return
+}
+
+// shrinkPool is called every poolCheckInterval, pool shrinks if no user connection waited during last interval.
+// Returns true if one idle work connection should be closed.
+func (ctl *Control) shrinkPool() (shrink bool) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.poolMisses == 0 && ctl.poolSize > ctl.poolCount {
+		ctl.poolSize--
+		shrink = true
+		ctl.conn.Debug("work connection pool shrinks to [%d]", ctl.poolSize)
+		StatsPoolSize(ctl.runId, ctl.poolSize)
+	}
+	ctl.poolMisses = 0
+	return
+}
+
 func (ctl *Control) Replaced(newCtl *Control) {
 	ctl.conn.Info("Replaced by client [%s]", newCtl.runId)
 	ctl.runId = ""
 	ctl.allShutdown.Start()
 }
 
+// Kick starts disconnecting the client, it returns without waiting for its proxies to be closed,
+// so callers like dashboard apis are not blocked by a slow shutdown.
+func (ctl *Control) Kick(reason string) {
+	ctl.conn.Info("Kicked: %s", reason)
+	ctl.allShutdown.Start()
+}
+
 func (ctl *Control) writer() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -223,9 +306,9 @@ func (ctl *Control) writer() {
 	defer ctl.writerShutdown.Done()
 
 	var xfrpWriter io.Writer
-	if config.ServerCommonCfg.UseEncryption {
+	if config.GetServerCommonCfg().UseEncryption {
 		var err error
-		xfrpWriter, err = crypto.NewWriter(ctl.conn, []byte(config.ServerCommonCfg.PrivilegeToken))
+		xfrpWriter, err = crypto.NewWriter(ctl.conn, []byte(ctl.authToken))
 		if err != nil {
 			ctl.conn.Error("crypto new writer error: %v", err)
 			ctl.allShutdown.Start()
@@ -259,8 +342,8 @@ func (ctl *Control) reader() {
 	defer ctl.readerShutdown.Done()
 
 	var xfrpReader io.Reader
-	if config.ServerCommonCfg.UseEncryption {
-		xfrpReader = crypto.NewReader(ctl.conn, []byte(config.ServerCommonCfg.PrivilegeToken))
+	if config.GetServerCommonCfg().UseEncryption {
+		xfrpReader = crypto.NewReader(ctl.conn, []byte(ctl.authToken))
 	} else {
 		xfrpReader = ctl.conn
 	}
@@ -302,7 +385,12 @@ func (ctl *Control) stoper() {
 		workConn.Close()
 	}
 
-	for _, pxy := range ctl.proxies {
+	// take all proxies away, so they aren't closed again by closeProxy at the same time
+	ctl.mu.Lock()
+	proxies := ctl.proxies
+	ctl.proxies = make([]Proxy, 0)
+	ctl.mu.Unlock()
+	for _, pxy := range proxies {
 		pxy.Close()
 		ctl.svr.DelProxy(pxy.GetName())
 		StatsCloseProxy(pxy.GetName(), pxy.GetConf().GetBaseInfo().ProxyType)
@@ -311,6 +399,9 @@ func (ctl *Control) stoper() {
 	ctl.allShutdown.Done()
 	ctl.conn.Info("client exit success")
 
+	// runId is empty if this control was replaced by a new one
+	ctl.svr.ctlManager.Del(ctl.runId, ctl)
+	ctl.svr.portManager.Offline(ctl.runId)
 	StatsCloseClient(ctl.runId)
 }
 
@@ -323,34 +414,45 @@ func (ctl *Control) manager() {
 
 	defer ctl.allShutdown.Start()
 	defer ctl.managerShutdown.Done()
+	// wait for proxy messages being handled, they may send responses before sendCh is closed
+	defer func() {
+		<-ctl.proxyMsgDone
+	}()
 
 	heartbeat := time.NewTicker(time.Second)
 	defer heartbeat.Stop()
+	poolCheck := time.NewTicker(poolCheckInterval)
+	defer poolCheck.Stop()
 
 	for {
 		select {
 		case <-heartbeat.C:
-			if time.Since(ctl.lastPing) > time.Duration(config.ServerCommonCfg.HeartBeatTimeout)*time.Second {
+			if time.Since(ctl.lastPing) > time.Duration(config.GetServerCommonCfg().HeartBeatTimeout)*time.Second {
 				ctl.conn.Warn("heartbeat timeout")
 				ctl.allShutdown.Start()
 			}
+		case <-poolCheck.C:
+			if ctl.shrinkPool() {
+				select {
+				case workConn := <-ctl.workConnCh:
+					workConn.Close()
+				default:
+				}
+			}
 		case rawMsg, ok := <-ctl.readCh:
 			if !ok {
 				return
 			}
 
 			switch m := rawMsg.(type) {
-			case *msg.NewProxy:
-				// register proxy in this control
-				resp, err := ctl.RegisterProxy(m)
-				if err != nil {
-					resp.Error = err.Error()
-					ctl.conn.Warn("new proxy [%s] error: %v", m.ProxyName, err)
-				} else {
-					ctl.conn.Info("new proxy [%s] success", m.ProxyName)
-					StatsNewProxy(m.ProxyName, m.ProxyType, ctl.runId)
-				}
-				ctl.sendCh <- resp
+			case *msg.NewProxy, *msg.CloseProxy:
+				prevDone, done := ctl.proxyMsgDone, make(chan struct{})
+				ctl.proxyMsgDone = done
+				go func() {
+					defer close(done)
+					<-prevDone
+					ctl.handleProxyMsg(m)
+				}()
 			case *msg.Ping:
 				ctl.lastPing = time.Now()
 				ctl.sendCh <- &msg.Pong{}
@@ -359,11 +461,75 @@ func (ctl *Control) manager() {
 	}
 }
 
+// handleProxyMsg handles NewProxy and CloseProxy messages out of manager, it may wait for plugins.
+func (ctl *Control) handleProxyMsg(rawMsg msg.Message) {
+	defer func() {
+		if err := recover(); err != nil {
+			ctl.conn.Error("panic error: %v", err)
+		}
+	}()
+
+	switch m := rawMsg.(type) {
+	case *msg.NewProxy:
+		// register proxy in this control
+		resp, err := ctl.RegisterProxy(m)
+		if err != nil {
+			resp.Error = err.Error()
+			ctl.conn.Warn("new proxy [%s] error: %v", m.ProxyName, err)
+		} else {
+			ctl.conn.Info("new proxy [%s] success", m.ProxyName)
+			StatsNewProxy(m.ProxyName, m.ProxyType, ctl.runId)
+		}
+		ctl.sendCh <- resp
+	case *msg.CloseProxy:
+		// client withdraws the proxy, so its port is not kept any more
+		if err := ctl.closeProxy(m.ProxyName); err != nil {
+			ctl.conn.Warn("close proxy [%s] error: %v", m.ProxyName, err)
+		} else {
+			ctl.svr.portManager.Free(ctl.runId, m.ProxyName)
+			ctl.conn.Info("close proxy [%s] success", m.ProxyName)
+		}
+	}
+}
+
 func (ctl *Control) RegisterProxy(pxyMsg *msg.NewProxy) (resp *msg.NewProxyResp, err error) {
 	resp = &msg.NewProxyResp{
 		ProxyName: pxyMsg.ProxyName,
 	}
 
+	// Plugins may reject the proxy or change its content, such as subdomain and remote port.
+	content, err := ctl.svr.pluginManager.NewProxy(&plugin.NewProxyContent{
+		User: plugin.UserInfo{
+			User:  ctl.loginMsg.User,
+			RunId: ctl.runId,
+		},
+		NewProxy: *pxyMsg,
+	})
+	if err != nil {
+		return
+	}
+	if content.ProxyName != pxyMsg.ProxyName {
+		err = fmt.Errorf("plugin can't change proxy name")
+		return
+	}
+	*pxyMsg = content.NewProxy
+
+	// client changed the proxy, the running one is replaced only after the new one is checked
+	oldPxy, replacing := ctl.getProxy(pxyMsg.ProxyName)
+
+	maxProxies := config.GetServerCommonCfg().MaxProxiesPerClient
+	ctl.mu.RLock()
+	proxyNum := int64(len(ctl.proxies))
+	ctl.mu.RUnlock()
+	if replacing {
+		proxyNum--
+	}
+	if maxProxies > 0 && proxyNum >= maxProxies {
+		err = fmt.Errorf("too many proxies, xfrps allows at most %d proxies of one client", maxProxies)
+		StatsRejectProxy()
+		return
+	}
+
 	var pxyConf config.ProxyConf
 	// Load configures from NewProxy message and check.
 	pxyConf, err = config.NewProxyConf(pxyMsg)
@@ -378,6 +544,17 @@ func (ctl *Control) RegisterProxy(pxyMsg *msg.NewProxy) (resp *msg.NewProxyResp,
 		return
 	}
 
+	// the old one keeps its port, it's started again if the new one can't run
+	if replacing {
+		ctl.closeProxy(pxyMsg.ProxyName)
+		ctl.conn.Info("proxy [%s] is replaced", pxyMsg.ProxyName)
+		defer func() {
+			if err != nil {
+				ctl.restoreProxy(oldPxy.GetConf())
+			}
+		}()
+	}
+
 	err = pxy.Run()
 	if err != nil {
 		return
@@ -399,7 +576,99 @@ func (ctl *Control) RegisterProxy(pxyMsg *msg.NewProxy) (resp *msg.NewProxyResp,
 	if err != nil {
 		return
 	}
+	ctl.mu.Lock()
 	ctl.proxies = append(ctl.proxies, pxy)
+	ctl.mu.Unlock()
 	err = nil
 	return
 }
+
+// RevokeProxy closes one proxy of this client and tells client the reason.
+// Its port is kept, the client may get it again when the proxy is allowed.
+func (ctl *Control) RevokeProxy(name string, reason string) (err error) {
+	if err = ctl.closeProxy(name); err != nil {
+		return
+	}
+	ctl.conn.Info("proxy [%s] is revoked: %s", name, reason)
+	return errors.PanicToError(func() {
+		ctl.sendCh <- &msg.CloseProxy{
+			ProxyName: name,
+			Reason:    reason,
+		}
+	})
+}
+
+// MoveProxy stops one proxy and tells client to register it again with the new port.
+func (ctl *Control) MoveProxy(name string, port int64, reason string) (err error) {
+	if err = ctl.closeProxy(name); err != nil {
+		return
+	}
+	ctl.conn.Info("proxy [%s] is moved to port [%d]: %s", name, port, reason)
+	return errors.PanicToError(func() {
+		ctl.sendCh <- &msg.CloseProxy{
+			ProxyName:  name,
+			Reason:     reason,
+			RemotePort: port,
+		}
+	})
+}
+
+// restoreProxy starts a proxy closed for replacing again with its old configures.
+func (ctl *Control) restoreProxy(pxyConf config.ProxyConf) {
+	baseInfo := pxyConf.GetBaseInfo()
+	pxy, err := NewProxy(ctl, pxyConf)
+	if err == nil {
+		err = pxy.Run()
+	}
+	if err == nil {
+		if err = ctl.svr.RegisterProxy(baseInfo.ProxyName, pxy); err != nil {
+			pxy.Close()
+		}
+	}
+	if err != nil {
+		ctl.conn.Warn("restore proxy [%s] error: %v", baseInfo.ProxyName, err)
+		return
+	}
+
+	ctl.mu.Lock()
+	ctl.proxies = append(ctl.proxies, pxy)
+	ctl.mu.Unlock()
+	ctl.conn.Info("proxy [%s] is restored", baseInfo.ProxyName)
+	StatsNewProxy(baseInfo.ProxyName, baseInfo.ProxyType, ctl.runId)
+}
+
+func (ctl *Control) getProxy(name string) (pxy Proxy, ok bool) {
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	for _, p := range ctl.proxies {
+		if p.GetName() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// closeProxy stops one proxy of this client, the client keeps online.
+func (ctl *Control) closeProxy(name string) (err error) {
+	ctl.mu.Lock()
+	var pxy Proxy
+	// build a new slice, the old one may be iterated by others after they unlock
+	proxies := make([]Proxy, 0, len(ctl.proxies))
+	for _, p := range ctl.proxies {
+		if pxy == nil && p.GetName() == name {
+			pxy = p
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+	ctl.proxies = proxies
+	ctl.mu.Unlock()
+
+	if pxy == nil {
+		return fmt.Errorf("proxy [%s] not found", name)
+	}
+	pxy.Close()
+	ctl.svr.DelProxy(name)
+	StatsCloseProxy(name, pxy.GetConf().GetBaseInfo().ProxyType)
+	return nil
+}
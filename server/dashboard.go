@@ -16,7 +16,6 @@ package server
 
 import (
 	"compress/gzip"
-	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -24,7 +23,6 @@ import (
 	"time"
 
 	"github.com/liudf0716/xfrps/assets"
-	"github.com/liudf0716/xfrps/models/config"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -34,31 +32,42 @@ var (
 	httpServerWriteTimeout = 10 * time.Second
 )
 
-func RunDashboardServer(addr string, port int64) (err error) {
+// RunDashboardServer serves dashboard on all listeners.
+func RunDashboardServer(lns ...net.Listener) {
 	// url router
 	router := httprouter.New()
 
 	// api, see dashboard_api.go
-	router.GET("/api/serverinfo", httprouterBasicAuth(apiServerInfo))
-	router.GET("/api/proxy/tcp", httprouterBasicAuth(apiProxyTcp))
-	router.GET("/api/proxy/udp", httprouterBasicAuth(apiProxyUdp))
-	router.GET("/api/proxy/ftp", httprouterBasicAuth(apiProxyFtp))
-	router.GET("/api/proxy/http", httprouterBasicAuth(apiProxyHttp))
-	router.GET("/api/proxy/https", httprouterBasicAuth(apiProxyHttps))
-	router.GET("/api/proxy/tcp/:pageNo", httprouterBasicAuth(apiProxyTcp))
-	router.GET("/api/proxy/udp/:pageNo", httprouterBasicAuth(apiProxyUdp))
-	router.GET("/api/proxy/ftp/:pageNo", httprouterBasicAuth(apiProxyFtp))
-	router.GET("/api/proxy/http/:pageNo", httprouterBasicAuth(apiProxyHttp))
-	router.GET("/api/proxy/https/:pageNo", httprouterBasicAuth(apiProxyHttps))
-	router.GET("/api/proxy/traffic/:name", httprouterBasicAuth(apiProxyTraffic))
-	router.GET("/api/client/online", httprouterBasicAuth(apiClientOnline))
-	router.GET("/api/client/online/:pageNo", httprouterBasicAuth(apiClientOnline))
-	router.GET("/api/client/offline", httprouterBasicAuth(apiClientOffline))
-	router.GET("/api/client/offline/:pageNo", httprouterBasicAuth(apiClientOffline))
-	router.GET("/api/port/getfree/:proto", httprouterNoAuth(apiGetFreePort))
-	router.GET("/api/port/tcp/isfree/:port", httprouterNoAuth(apiIsTcpPortFree))
-	router.GET("/api/port/tcp/getport/:runid", httprouterNoAuth(apiGetPort))       // according runid, getting tcp port
-	router.GET("/api/port/tcp/getftpport/:runid", httprouterNoAuth(apiGetFtpPort)) // according runid, getting its ftp control port
+	router.GET("/api/serverinfo", httprouterAuth(ScopeRead, apiServerInfo))
+	router.GET("/api/proxy/tcp", httprouterAuth(ScopeRead, apiProxyTcp))
+	router.GET("/api/proxy/udp", httprouterAuth(ScopeRead, apiProxyUdp))
+	router.GET("/api/proxy/ftp", httprouterAuth(ScopeRead, apiProxyFtp))
+	router.GET("/api/proxy/http", httprouterAuth(ScopeRead, apiProxyHttp))
+	router.GET("/api/proxy/https", httprouterAuth(ScopeRead, apiProxyHttps))
+	router.GET("/api/proxy/tcp/:pageNo", httprouterAuth(ScopeRead, apiProxyTcp))
+	router.GET("/api/proxy/udp/:pageNo", httprouterAuth(ScopeRead, apiProxyUdp))
+	router.GET("/api/proxy/ftp/:pageNo", httprouterAuth(ScopeRead, apiProxyFtp))
+	router.GET("/api/proxy/http/:pageNo", httprouterAuth(ScopeRead, apiProxyHttp))
+	router.GET("/api/proxy/https/:pageNo", httprouterAuth(ScopeRead, apiProxyHttps))
+	router.GET("/api/proxy/traffic/:name", httprouterAuth(ScopeRead, apiProxyTraffic))
+	router.GET("/api/client/online", httprouterAuth(ScopeRead, apiClientOnline))
+	router.GET("/api/client/online/:pageNo", httprouterAuth(ScopeRead, apiClientOnline))
+	router.GET("/api/client/offline", httprouterAuth(ScopeRead, apiClientOffline))
+	router.GET("/api/client/offline/:pageNo", httprouterAuth(ScopeRead, apiClientOffline))
+	router.POST("/api/reload", httprouterAuth(ScopeAdmin, apiReload))
+	router.POST("/api/proxy/close/:name", httprouterAuth(ScopeAdmin, apiCloseProxy))
+	router.POST("/api/client/kick/:runid", httprouterAuth(ScopeAdmin, apiKickClient))
+	router.POST("/api/client/ban/:runid", httprouterAuth(ScopeAdmin, apiBanClient))
+	router.POST("/api/client/unban/:runid", httprouterAuth(ScopeAdmin, apiUnbanClient))
+	router.GET("/api/client/banned", httprouterAuth(ScopeRead, apiBannedClients))
+	router.POST("/api/port/release/:runid/:name", httprouterAuth(ScopeAdmin, apiReleasePort))
+	router.POST("/api/port/reassign/:runid/:name", httprouterAuth(ScopeAdmin, apiReassignPort))
+	router.GET("/metrics", prometheusAuth(apiMetrics))
+	router.GET("/api/port/getfree/:proto", httprouterAuth(ScopePort, apiGetFreePort))
+	router.GET("/api/port/tcp/isfree/:port", httprouterAuth(ScopePort, apiIsTcpPortFree))
+	router.GET("/api/port/tcp/getport/:runid", httprouterDeviceAuth(apiGetPort))            // according runid, getting tcp port
+	router.GET("/api/port/tcp/getport/:runid/:name", httprouterDeviceAuth(apiGetProxyPort)) // according runid and proxy name, getting its port
+	router.GET("/api/port/tcp/getftpport/:runid", httprouterDeviceAuth(apiGetFtpPort))      // according runid, getting its ftp control port
 
 	// view
 	router.Handler("GET", "/favicon.ico", http.FileServer(assets.FileSystem))
@@ -67,23 +76,14 @@ func RunDashboardServer(addr string, port int64) (err error) {
 		http.Redirect(w, r, "/static/", http.StatusMovedPermanently)
 	}))
 
-	address := fmt.Sprintf("%s:%d", addr, port)
 	server := &http.Server{
-		Addr:         address,
 		Handler:      router,
 		ReadTimeout:  httpServerReadTimeout,
 		WriteTimeout: httpServerWriteTimeout,
 	}
-	if address == "" {
-		address = ":http"
+	for _, ln := range lns {
+		go server.Serve(ln)
 	}
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		return err
-	}
-
-	go server.Serve(ln)
-	return
 }
 
 func use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
@@ -94,14 +94,12 @@ func use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFu
 }
 
 type AuthWraper struct {
-	h      http.Handler
-	user   string
-	passwd string
+	h http.Handler
 }
 
+// ServeHTTP checks user and password from configures on every request, so they can be reloaded.
 func (aw *AuthWraper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	user, passwd, hasAuth := r.BasicAuth()
-	if (aw.user == "" && aw.passwd == "") || (hasAuth && user == aw.user && passwd == aw.passwd) {
+	if checkBasicAuth(r, ScopeRead) {
 		aw.h.ServeHTTP(w, r)
 	} else {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -111,17 +109,13 @@ func (aw *AuthWraper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func basicAuthWraper(h http.Handler) http.Handler {
 	return &AuthWraper{
-		h:      h,
-		user:   config.ServerCommonCfg.DashboardUser,
-		passwd: config.ServerCommonCfg.DashboardPwd,
+		h: h,
 	}
 }
 
 func basicAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, passwd, hasAuth := r.BasicAuth()
-		if (config.ServerCommonCfg.DashboardUser == "" && config.ServerCommonCfg.DashboardPwd == "") ||
-			(hasAuth && user == config.ServerCommonCfg.DashboardUser && passwd == config.ServerCommonCfg.DashboardPwd) {
+		if checkBasicAuth(r, ScopeRead) {
 			h.ServeHTTP(w, r)
 		} else {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -130,26 +124,6 @@ func basicAuth(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func httprouterBasicAuth(h httprouter.Handle) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		user, passwd, hasAuth := r.BasicAuth()
-		if (config.ServerCommonCfg.DashboardUser == "" && config.ServerCommonCfg.DashboardPwd == "") ||
-			(hasAuth && user == config.ServerCommonCfg.DashboardUser && passwd == config.ServerCommonCfg.DashboardPwd) {
-			h(w, r, ps)
-		} else {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		}
-	}
-}
-
-func httprouterNoAuth(h httprouter.Handle) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		h(w, r, ps)
-	}
-}
-
 type GzipWraper struct {
 	h http.Handler
 }
@@ -16,6 +16,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -54,6 +55,13 @@ type ServerInfoResp struct {
 	ClientCounts        int64            `json:"client_counts"`
 	OfflineClientCounts int64            `json:"offline_client_counts"`
 	ProxyTypeCounts     map[string]int64 `json:"proxy_type_count"`
+	PoolHitCount        int64            `json:"pool_hit_count"`
+	PoolMissCount       int64            `json:"pool_miss_count"`
+	RejectedClientCount int64            `json:"rejected_client_count"`
+	RejectedProxyCount  int64            `json:"rejected_proxy_count"`
+	RejectedConnCount   int64            `json:"rejected_conn_count"`
+	RejectedIpConnCount int64            `json:"rejected_ip_conn_count"`
+	DeniedConnCount     int64            `json:"denied_conn_count"`
 }
 
 func apiServerInfo(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -66,7 +74,7 @@ func apiServerInfo(w http.ResponseWriter, r *http.Request, params httprouter.Par
 	}()
 
 	log.Info("Http request: [/api/serverinfo]")
-	cfg := config.ServerCommonCfg
+	cfg := config.GetServerCommonCfg()
 	serverStats := StatsGetServer()
 	res = ServerInfoResp{
 		Version:          version.Full(),
@@ -83,6 +91,13 @@ func apiServerInfo(w http.ResponseWriter, r *http.Request, params httprouter.Par
 		ClientCounts:        serverStats.ClientCounts,
 		OfflineClientCounts: serverStats.OfflineClientCounts,
 		ProxyTypeCounts:     serverStats.ProxyTypeCounts,
+		PoolHitCount:        serverStats.PoolHits,
+		PoolMissCount:       serverStats.PoolMisses,
+		RejectedClientCount: serverStats.RejectedClients,
+		RejectedProxyCount:  serverStats.RejectedProxies,
+		RejectedConnCount:   serverStats.RejectedConns,
+		RejectedIpConnCount: serverStats.RejectedIpConns,
+		DeniedConnCount:     serverStats.DeniedConns,
 	}
 
 	buf, _ = json.Marshal(&res)
@@ -94,6 +109,9 @@ type ClientStatsInfo struct {
 	RunId         string `json:"runid"`
 	ProxyNum      int64  `json:"proxy_num"`
 	ConnNum       int64  `json:"conn_num"`
+	PoolSize      int64  `json:"pool_size"`
+	PoolHitCount  int64  `json:"pool_hit_count"`
+	PoolMissCount int64  `json:"pool_miss_count"`
 	LastStartTime string `json:"last_start_time"`
 	LastCloseTime string `json:"last_close_time"`
 }
@@ -158,6 +176,9 @@ func getClientStatsByPage(pageNo int, pageSize int) (clientInfos []*ClientStatsI
 		clientInfo.RunId = ps.RunId
 		clientInfo.ProxyNum = ps.ProxyNum
 		clientInfo.ConnNum = ps.ConnNum
+		clientInfo.PoolSize = ps.PoolSize
+		clientInfo.PoolHitCount = ps.PoolHits
+		clientInfo.PoolMissCount = ps.PoolMisses
 		clientInfo.LastStartTime = ps.LastStartTime
 		clientInfo.LastCloseTime = ps.LastCloseTime
 		clientInfos = append(clientInfos, clientInfo)
@@ -172,6 +193,10 @@ type ProxyStatsInfo struct {
 	TodayTrafficIn  int64            `json:"today_traffic_in"`
 	TodayTrafficOut int64            `json:"today_traffic_out"`
 	CurConns        int64            `json:"cur_conns"`
+	InRate          int64            `json:"in_rate"`
+	OutRate         int64            `json:"out_rate"`
+	RejectedConns   int64            `json:"rejected_conns"`
+	DeniedConns     int64            `json:"denied_conns"`
 	LastStartTime   string           `json:"last_start_time"`
 	LastCloseTime   string           `json:"last_close_time"`
 	Status          string           `json:"status"`
@@ -251,6 +276,10 @@ func getProxyStatsPageByType(proxyType string, pageNo int, pageSize int) (proxyI
 		proxyInfo.TodayTrafficIn = ps.TodayTrafficIn
 		proxyInfo.TodayTrafficOut = ps.TodayTrafficOut
 		proxyInfo.CurConns = ps.CurConns
+		proxyInfo.InRate = ps.InRate
+		proxyInfo.OutRate = ps.OutRate
+		proxyInfo.RejectedConns = ps.RejectedConns
+		proxyInfo.DeniedConns = ps.DeniedConns
 		proxyInfo.LastStartTime = ps.LastStartTime
 		proxyInfo.LastCloseTime = ps.LastCloseTime
 		proxyInfos = append(proxyInfos, proxyInfo)
@@ -365,10 +394,19 @@ func apiIsTcpPortFree(w http.ResponseWriter, r *http.Request, params httprouter.
 	w.Write(buf)
 }
 
+type ProxyPortInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Port int64  `json:"port"`
+}
+
 type GetPortResp struct {
 	GeneralResponse
 
+	// port of client's first tcp proxy, for clients which have only one tcp proxy
 	Port int64 `json:"port"`
+
+	Proxies []*ProxyPortInfo `json:"proxies,omitempty"`
 }
 
 // /api/port/tcp/getport/:runid
@@ -388,7 +426,17 @@ func apiGetPort(w http.ResponseWriter, r *http.Request, params httprouter.Params
 	port, ok := ServerService.portManager.GetById(runid)
 	if ok {
 		res.Port = port
-	} else {
+	}
+	res.Proxies = make([]*ProxyPortInfo, 0)
+	for _, pp := range ServerService.portManager.GetProxyPorts(runid) {
+		res.Proxies = append(res.Proxies, &ProxyPortInfo{
+			Name: pp.ProxyName,
+			Type: pp.ProxyType,
+			Port: pp.Port,
+		})
+	}
+	// code is not 0 if the client has no tcp port like before, even if it has ports of other proxies
+	if !ok {
 		res.Code = 1
 		res.Msg = "can not get port by its runid"
 	}
@@ -397,6 +445,32 @@ func apiGetPort(w http.ResponseWriter, r *http.Request, params httprouter.Params
 	w.Write(buf)
 }
 
+// /api/port/tcp/getport/:runid/:name
+func apiGetProxyPort(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GetPortResp
+	)
+
+	runid := params.ByName("runid")
+	name := params.ByName("name")
+	defer func() {
+		log.Info("Http response [/api/port/tcp/getport/:runid/:name]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/port/tcp/getport/:runid/:name]")
+
+	port, ok := ServerService.portManager.GetByName(runid, name)
+	if ok {
+		res.Port = port
+	} else {
+		res.Code = 1
+		res.Msg = "can not get port by its runid and proxy name"
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
 // /api/port/tcp/getftpport/:runid
 func apiGetFtpPort(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	var (
@@ -421,3 +495,222 @@ func apiGetFtpPort(w http.ResponseWriter, r *http.Request, params httprouter.Par
 	buf, _ = json.Marshal(&res)
 	w.Write(buf)
 }
+
+// /api/reload
+type ReloadResp struct {
+	GeneralResponse
+
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+func apiReload(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res ReloadResp
+	)
+	defer func() {
+		log.Info("Http response [/api/reload]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/reload]")
+
+	changed, restartRequired, err := ServerService.ReloadConf()
+	auditLog(r, "reload", "", err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	} else {
+		res.Changed = changed
+		res.RestartRequired = restartRequired
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/proxy/close/:name, reason is sent to client
+func apiCloseProxy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	name := params.ByName("name")
+	defer func() {
+		log.Info("Http response [/api/proxy/close/:name]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/proxy/close/:name]")
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed by administrator"
+	}
+	err := ServerService.CloseProxy(name, reason)
+	auditLog(r, "close proxy", name, err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// auditLog records who did an administrative operation and its result.
+func auditLog(r *http.Request, action string, target string, err error) {
+	user := dashboardUser(r)
+	result := "success"
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	log.Info("audit: user [%s] from [%s] %s [%s]: %s", user, r.RemoteAddr, action, target, result)
+}
+
+// api/client/kick/:runid, client can login again unless it's banned
+func apiKickClient(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	runid := params.ByName("runid")
+	defer func() {
+		log.Info("Http response [/api/client/kick/:runid]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/client/kick/:runid]")
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "kicked by administrator"
+	}
+	err := ServerService.KickClient(runid, reason)
+	auditLog(r, "kick client", runid, err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/client/ban/:runid, client is kicked if it's online
+func apiBanClient(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	runid := params.ByName("runid")
+	defer func() {
+		log.Info("Http response [/api/client/ban/:runid]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/client/ban/:runid]")
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "banned by administrator"
+	}
+	ServerService.BanClient(runid, reason)
+	auditLog(r, "ban client", runid, nil)
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/client/unban/:runid
+func apiUnbanClient(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	runid := params.ByName("runid")
+	defer func() {
+		log.Info("Http response [/api/client/unban/:runid]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/client/unban/:runid]")
+
+	err := ServerService.UnbanClient(runid)
+	auditLog(r, "unban client", runid, err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/client/banned
+type BannedClientsResp struct {
+	GeneralResponse
+
+	// ban reasons indexed by run id
+	Clients map[string]string `json:"clients"`
+}
+
+func apiBannedClients(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res BannedClientsResp
+	)
+	defer func() {
+		log.Info("Http response [/api/client/banned]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/client/banned]")
+
+	res.Clients = ServerService.banManager.GetAll()
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/port/release/:runid/:name, proxy gets a new port when it's registered again
+func apiReleasePort(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	runid := params.ByName("runid")
+	name := params.ByName("name")
+	defer func() {
+		log.Info("Http response [/api/port/release/:runid/:name]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/port/release/:runid/:name]")
+
+	err := ServerService.ReleasePort(runid, name)
+	auditLog(r, "release port", runid+"/"+name, err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
+
+// api/port/reassign/:runid/:name?port=
+func apiReassignPort(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var (
+		buf []byte
+		res GeneralResponse
+	)
+	runid := params.ByName("runid")
+	name := params.ByName("name")
+	defer func() {
+		log.Info("Http response [/api/port/reassign/:runid/:name]: code [%d]", res.Code)
+	}()
+	log.Info("Http request: [/api/port/reassign/:runid/:name]")
+
+	port, err := strconv.ParseInt(r.URL.Query().Get("port"), 10, 64)
+	if err != nil {
+		err = fmt.Errorf("port is incorrect")
+	} else {
+		err = ServerService.ReassignPort(runid, name, port)
+	}
+	auditLog(r, "reassign port", fmt.Sprintf("%s/%s to %s", runid, name, r.URL.Query().Get("port")), err)
+	if err != nil {
+		res.Code = 1
+		res.Msg = err.Error()
+	}
+
+	buf, _ = json.Marshal(&res)
+	w.Write(buf)
+}
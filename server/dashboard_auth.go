@@ -0,0 +1,271 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/utils/log"
+
+	"github.com/julienschmidt/httprouter"
+	ini "github.com/vaughan0/go-ini"
+)
+
+// Scopes of dashboard api tokens, ScopeAdmin grants all scopes.
+const (
+	ScopeRead  = "read"
+	ScopePort  = "port"
+	ScopeAdmin = "admin"
+)
+
+// ApiToken is one token of dashboard api, only the sha256 of the token is kept.
+type ApiToken struct {
+	Name   string
+	Scopes map[string]bool
+}
+
+func (t *ApiToken) HasScope(scope string) bool {
+	return t.Scopes[ScopeAdmin] || t.Scopes[scope]
+}
+
+// TokenStore looks up dashboard api tokens.
+type TokenStore interface {
+	// Get returns the token, ok is false if it doesn't exist.
+	Get(token string) (t *ApiToken, ok bool, err error)
+
+	// GetByName returns the token by its name, it's used for client certificates.
+	GetByName(name string) (t *ApiToken, ok bool, err error)
+}
+
+// IniTokenStore reads tokens from an ini file, each section is a token:
+//
+//	[name of the token]
+//	sha256 = hex sha256 of the token
+//	scopes = read, port
+//
+// sha256 can be omitted if the token is only used by client certificates with the same common name.
+//
+// The file is reloaded when it's modified, so tokens can be added or removed without restarting xfrps.
+type IniTokenStore struct {
+	path    string
+	modTime time.Time
+
+	// indexed by hex sha256 of token
+	tokens map[string]*ApiToken
+	// indexed by name of token
+	names map[string]*ApiToken
+
+	mu sync.Mutex
+}
+
+func NewIniTokenStore(path string) (s *IniTokenStore, err error) {
+	s = &IniTokenStore{
+		path:   path,
+		tokens: make(map[string]*ApiToken),
+		names:  make(map[string]*ApiToken),
+	}
+	err = s.reload()
+	return
+}
+
+func (s *IniTokenStore) Get(token string) (t *ApiToken, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.reload(); err != nil {
+		return
+	}
+	t, ok = s.tokens[HashToken(token)]
+	return
+}
+
+func (s *IniTokenStore) GetByName(name string) (t *ApiToken, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.reload(); err != nil {
+		return
+	}
+	t, ok = s.names[name]
+	return
+}
+
+// reload must be called with s.mu locked.
+func (s *IniTokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	conf, err := ini.LoadFile(s.path)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]*ApiToken)
+	names := make(map[string]*ApiToken)
+	for name, section := range conf {
+		if name == "" {
+			continue
+		}
+		hash := strings.ToLower(section["sha256"])
+		if hash != "" && len(hash) != sha256.Size*2 {
+			return fmt.Errorf("sha256 of token [%s] is incorrect", name)
+		}
+		t := &ApiToken{
+			Name:   name,
+			Scopes: make(map[string]bool),
+		}
+		for _, scope := range strings.Split(section["scopes"], ",") {
+			scope = strings.TrimSpace(scope)
+			switch scope {
+			case ScopeRead, ScopePort, ScopeAdmin:
+				t.Scopes[scope] = true
+			case "":
+			default:
+				return fmt.Errorf("scope [%s] of token [%s] is incorrect", scope, name)
+			}
+		}
+		if hash != "" {
+			tokens[hash] = t
+		}
+		names[name] = t
+	}
+	s.tokens = tokens
+	s.names = names
+	s.modTime = info.ModTime()
+	log.Info("load [%d] dashboard tokens from [%s]", len(names), s.path)
+	return nil
+}
+
+// HashToken returns hex sha256 of token, as it's written in dashboard token file.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) (token string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// checkBasicAuth checks dashboard_user and dashboard_pwd, they grant all scopes.
+// If both are empty, no auth is required for ScopeRead unless dashboard token file is used,
+// ScopePort and ScopeAdmin always require user and password or a token, so ports can't be looked up anonymously.
+func checkBasicAuth(r *http.Request, scope string) bool {
+	cfg := config.GetServerCommonCfg()
+	if cfg.DashboardUser == "" && cfg.DashboardPwd == "" {
+		return cfg.DashboardTokenFile == "" && scope == ScopeRead
+	}
+	user, passwd, hasAuth := r.BasicAuth()
+	return hasAuth &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(cfg.DashboardUser)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(passwd), []byte(cfg.DashboardPwd)) == 1
+}
+
+// getApiToken returns the valid token of request, ok is false if there isn't one.
+// A verified client certificate is the token named by its common name.
+func getApiToken(r *http.Request) (t *ApiToken, ok bool) {
+	if ServerService == nil || ServerService.tokenStore == nil {
+		return nil, false
+	}
+	var err error
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		t, ok, err = ServerService.tokenStore.GetByName(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	} else {
+		var token string
+		if token, ok = bearerToken(r); !ok {
+			return nil, false
+		}
+		t, ok, err = ServerService.tokenStore.Get(token)
+	}
+	if err != nil {
+		log.Warn("get dashboard token error: %v", err)
+		return nil, false
+	}
+	return
+}
+
+// checkDeviceAuth checks if request carries the token of client runId in auth_file.
+func checkDeviceAuth(r *http.Request, runId string) bool {
+	token, ok := bearerToken(r)
+	if !ok || runId == "" || ServerService == nil || ServerService.credStore == nil {
+		return false
+	}
+	cred, ok, err := ServerService.credStore.Get(runId)
+	if err != nil {
+		log.Warn("get credential of [%s] error: %v", runId, err)
+		return false
+	}
+	return ok && !cred.Revoked && cred.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(cred.Token)) == 1
+}
+
+// dashboardUser returns who sent the request, for audit logs.
+func dashboardUser(r *http.Request) string {
+	if t, ok := getApiToken(r); ok {
+		return "token:" + t.Name
+	}
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// httprouterAuth allows requests with dashboard user and password, or with a token which has scope.
+func httprouterAuth(scope string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if checkBasicAuth(r, scope) {
+			h(w, r, ps)
+			return
+		}
+		if t, ok := getApiToken(r); ok {
+			if t.HasScope(scope) {
+				h(w, r, ps)
+			} else {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			}
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// httprouterDeviceAuth allows port lookups of one client with the client's own token in auth_file,
+// besides everything allowed by httprouterAuth with ScopePort.
+func httprouterDeviceAuth(h httprouter.Handle) httprouter.Handle {
+	scoped := httprouterAuth(ScopePort, h)
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if checkDeviceAuth(r, ps.ByName("runid")) {
+			h(w, r, ps)
+			return
+		}
+		scoped(w, r, ps)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liudf0716/xfrps/models/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.GetDefaultServerCommonConf()
+	cfg.DashboardUser = ""
+	cfg.DashboardPwd = ""
+	config.SetServerCommonCfg(cfg)
+
+	// without user and password, only read scope is open
+	r := httptest.NewRequest("GET", "/api/serverinfo", nil)
+	assert.True(checkBasicAuth(r, ScopeRead))
+	assert.False(checkBasicAuth(r, ScopePort))
+	assert.False(checkBasicAuth(r, ScopeAdmin))
+
+	cfg.DashboardTokenFile = "tokens.ini"
+	assert.False(checkBasicAuth(r, ScopeRead))
+
+	cfg.DashboardUser = "ops"
+	cfg.DashboardPwd = "secret"
+	assert.False(checkBasicAuth(r, ScopeRead))
+	r.SetBasicAuth("ops", "wrong")
+	assert.False(checkBasicAuth(r, ScopeRead))
+	r.SetBasicAuth("ops", "secret")
+	assert.True(checkBasicAuth(r, ScopeRead))
+	assert.True(checkBasicAuth(r, ScopePort))
+	assert.True(checkBasicAuth(r, ScopeAdmin))
+}
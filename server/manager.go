@@ -16,61 +16,359 @@ package server
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/models/consts"
+	"github.com/liudf0716/xfrps/utils/log"
+	"github.com/liudf0716/xfrps/utils/port"
 )
 
 type PortManager struct {
-	freePort map[string]int64
-	ftpPort  map[string]int64
+	// ports allocated for clients, indexed by run id
+	records map[string]*PortRecord
+
+	// allocate ports from allowed port ranges
+	allocator *port.Allocator
+
+	// if store is nil, port allocations are only kept in memory
+	store PortStore
+	dirty bool
 
 	mu sync.RWMutex
 }
 
-func NewPortManager() *PortManager {
-	return &PortManager{
-		freePort: make(map[string]int64),
-		ftpPort:  make(map[string]int64),
+func NewPortManager(store PortStore, portRanges [][2]int64) (pm *PortManager, err error) {
+	pm = &PortManager{
+		records:   make(map[string]*PortRecord),
+		allocator: port.NewAllocator(portRanges),
+		store:     store,
 	}
+	if store == nil {
+		return
+	}
+
+	snapshot, err := store.Load()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for runId, record := range snapshot.Records {
+		for name, pp := range record.Ports {
+			if !pm.load(runId, pp.Port) {
+				delete(record.Ports, name)
+			}
+		}
+		if len(record.Ports) == 0 {
+			continue
+		}
+		// no client is online when xfrps starts
+		if record.OfflineTime == 0 {
+			record.OfflineTime = now
+		}
+		pm.records[runId] = record
+	}
+	log.Info("load port allocations of [%d] clients from port store", len(pm.records))
+	return
 }
 
-func (pm *PortManager) Add(runId string, port int64) (oldPort int64) {
+// load marks port loaded from store as used.
+// Ports not allowed any more or conflicting with others are dropped.
+func (pm *PortManager) load(runId string, p int64) bool {
+	if !pm.allocator.Contains(p) {
+		log.Warn("drop port [%d] of client [%s], it isn't allowed now", p, runId)
+		return false
+	}
+	if err := pm.allocator.Acquire(p); err != nil {
+		log.Warn("drop port [%d] of client [%s], %v", p, runId, err)
+		return false
+	}
+	return true
+}
+
+// Alloc returns the port allocated for proxy of client, a new port is allocated if it doesn't have one yet.
+// The same proxy of one client always gets the same port until its allocation expired.
+func (pm *PortManager) Alloc(runId string, proxyName string, proxyType string) (port int64, err error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	oldPort, ok := pm.freePort[runId]
-	if ok {
+	record, ok := pm.records[runId]
+	if !ok {
+		record = &PortRecord{
+			Ports: make(map[string]*ProxyPort),
+		}
+		pm.records[runId] = record
+	}
+
+	if pp, ok := record.Ports[proxyName]; ok {
+		if pp.ProxyType == proxyType {
+			return pp.Port, nil
+		}
+		// proxy type changed, its old port can't be used any more
+		pm.allocator.Release(pp.Port)
+		delete(record.Ports, proxyName)
+	}
+
+	if port, err = pm.allocator.Get(); err != nil {
 		return
 	}
-	pm.freePort[runId] = port
+	record.Ports[proxyName] = &ProxyPort{
+		ProxyName:  proxyName,
+		ProxyType:  proxyType,
+		Port:       port,
+		CreateTime: time.Now().Unix(),
+	}
+	pm.save()
 	return
 }
 
-func (pm *PortManager) AddFtp(runId string, port int64) (oldPort int64) {
+// Acquire marks port specified by client as used, so it won't be allocated to others.
+// If the port is already allocated to this client, acquired is false and nothing needs to be released.
+func (pm *PortManager) Acquire(runId string, port int64) (acquired bool, err error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	oldPort, ok := pm.ftpPort[runId]
-	if ok {
+	if record, ok := pm.records[runId]; ok {
+		for _, pp := range record.Ports {
+			if pp.Port == port {
+				return false, nil
+			}
+		}
+	}
+	if !pm.allocator.Contains(port) {
+		return false, nil
+	}
+	if err = pm.allocator.Acquire(port); err != nil {
+		return false, fmt.Errorf("remote port [%d] is already in use", port)
+	}
+	return true, nil
+}
+
+// SetPortRanges changes port ranges for allocating, ports allocated before are kept.
+func (pm *PortManager) SetPortRanges(portRanges [][2]int64) {
+	pm.allocator.SetPortRanges(portRanges)
+}
+
+// Release gives back port acquired by Acquire, or the old port replaced by Realloc.
+func (pm *PortManager) Release(port int64) {
+	pm.allocator.Release(port)
+}
+
+// Free releases the port allocated for one proxy of client, it's called when client withdraws the proxy.
+func (pm *PortManager) Free(runId string, proxyName string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	record, ok := pm.records[runId]
+	if !ok {
 		return
 	}
-	pm.ftpPort[runId] = port
-	return
+	pp, ok := record.Ports[proxyName]
+	if !ok {
+		return
+	}
+	pm.allocator.Release(pp.Port)
+	delete(record.Ports, proxyName)
+	pm.save()
 }
 
-func (pm *PortManager) GetById(runId string) (port int64, ok bool) {
+// Realloc allocates another port for proxy of client whose port is oldPort.
+// oldPort is kept in use so it's never allocated again, the caller gives it back by Release.
+func (pm *PortManager) Realloc(runId string, proxyName string, oldPort int64) (port int64, err error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	port, ok = pm.freePort[runId]
+	record, ok := pm.records[runId]
+	if !ok {
+		return 0, fmt.Errorf("client [%s] has no port", runId)
+	}
+	pp, ok := record.Ports[proxyName]
+	if !ok || pp.Port != oldPort {
+		return 0, fmt.Errorf("port [%d] is not allocated for proxy [%s] of client [%s]", oldPort, proxyName, runId)
+	}
+	if port, err = pm.allocator.Get(); err != nil {
+		return
+	}
+	pp.Port = port
+	pm.save()
 	return
 }
 
-func (pm *PortManager) GetFtpById(runId string) (port int64, ok bool) {
+// Reassign changes the port allocated for one proxy of client, the new port must be allowed and not in use.
+func (pm *PortManager) Reassign(runId string, proxyName string, port int64) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	port, ok = pm.ftpPort[runId]
+	record, ok := pm.records[runId]
+	if !ok {
+		return fmt.Errorf("client [%s] has no port", runId)
+	}
+	pp, ok := record.Ports[proxyName]
+	if !ok {
+		return fmt.Errorf("proxy [%s] of client [%s] has no port", proxyName, runId)
+	}
+	if pp.Port == port {
+		return nil
+	}
+	if !pm.allocator.Contains(port) {
+		return fmt.Errorf("port [%d] is not allowed", port)
+	}
+	if err := pm.allocator.Acquire(port); err != nil {
+		return fmt.Errorf("port [%d] is already in use", port)
+	}
+	pm.allocator.Release(pp.Port)
+	pp.Port = port
+	pm.save()
+	return nil
+}
+
+// GetById returns the port of client's first tcp proxy, it's for clients which have only one tcp proxy.
+func (pm *PortManager) GetById(runId string) (port int64, ok bool) {
+	return pm.getFirstByType(runId, consts.TcpProxy)
+}
+
+// GetFtpById returns the control port of client's first ftp proxy.
+func (pm *PortManager) GetFtpById(runId string) (port int64, ok bool) {
+	return pm.getFirstByType(runId, consts.FtpProxy)
+}
+
+func (pm *PortManager) getFirstByType(runId string, proxyType string) (port int64, ok bool) {
+	var first *ProxyPort
+	for _, pp := range pm.GetProxyPorts(runId) {
+		if pp.ProxyType != proxyType || strings.HasSuffix(pp.ProxyName, consts.FtpDataProxySuffix) {
+			continue
+		}
+		if first == nil || pp.CreateTime < first.CreateTime ||
+			(pp.CreateTime == first.CreateTime && pp.ProxyName < first.ProxyName) {
+			first = pp
+		}
+	}
+	if first == nil {
+		return 0, false
+	}
+	return first.Port, true
+}
+
+// GetByName returns the port allocated for one proxy of client.
+func (pm *PortManager) GetByName(runId string, proxyName string) (port int64, ok bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	record, ok := pm.records[runId]
+	if !ok {
+		return
+	}
+	pp, ok := record.Ports[proxyName]
+	if !ok {
+		return
+	}
+	return pp.Port, true
+}
+
+// GetProxyPorts returns ports of all proxies of client, sorted by proxy name.
+func (pm *PortManager) GetProxyPorts(runId string) (ports []*ProxyPort) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	ports = make([]*ProxyPort, 0)
+	record, ok := pm.records[runId]
+	if !ok {
+		return
+	}
+	for _, pp := range record.Ports {
+		tmp := *pp
+		ports = append(ports, &tmp)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].ProxyName < ports[j].ProxyName
+	})
 	return
 }
 
+// Online marks client's ports as in use, they will never expire until the client goes offline.
+func (pm *PortManager) Online(runId string) {
+	if runId == "" {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if record, ok := pm.records[runId]; ok {
+		record.OfflineTime = 0
+		pm.dirty = true
+	}
+}
+
+func (pm *PortManager) Offline(runId string) {
+	if runId == "" {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if record, ok := pm.records[runId]; ok {
+		record.OfflineTime = time.Now().Unix()
+		pm.dirty = true
+	}
+}
+
+// ClearExpired releases ports of clients which have been offline longer than maxAge.
+func (pm *PortManager) ClearExpired(maxAge time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for runId, record := range pm.records {
+		if record.OfflineTime == 0 {
+			continue
+		}
+		offlineTime := time.Unix(record.OfflineTime, 0)
+		if time.Since(offlineTime) > maxAge {
+			for _, pp := range record.Ports {
+				pm.allocator.Release(pp.Port)
+			}
+			delete(pm.records, runId)
+			pm.dirty = true
+			log.Info("release ports of client [%s], offline since [%s]", runId, offlineTime.String())
+		}
+	}
+	if pm.dirty {
+		pm.save()
+	}
+}
+
+// Flush saves online status changes which are not saved immediately.
+func (pm *PortManager) Flush() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.dirty {
+		pm.save()
+	}
+}
+
+// Run checks expired port allocations every checkInterval.
+// If maxAge is 0, port allocations never expire.
+func (pm *PortManager) Run(checkInterval time.Duration, maxAge time.Duration) {
+	for {
+		time.Sleep(checkInterval)
+		if maxAge > 0 {
+			pm.ClearExpired(maxAge)
+		} else {
+			pm.Flush()
+		}
+	}
+}
+
+// save must be called with pm.mu locked.
+func (pm *PortManager) save() {
+	if pm.store == nil {
+		return
+	}
+
+	snapshot := &PortSnapshot{
+		Version: PortStoreVersion,
+		Records: pm.records,
+	}
+	if err := pm.store.Save(snapshot); err != nil {
+		log.Warn("save port allocations error: %v", err)
+		return
+	}
+	pm.dirty = false
+}
+
 type ControlManager struct {
 	// controls indexed by run id
 	ctlsByRunId map[string]*Control
@@ -84,18 +382,31 @@ func NewControlManager() *ControlManager {
 	}
 }
 
-func (cm *ControlManager) Add(runId string, ctl *Control) (oldCtl *Control) {
+// Add replaces the control with the same run id, new clients are rejected if there are maxClients clients already.
+// maxClients 0 means no limit.
+func (cm *ControlManager) Add(runId string, ctl *Control, maxClients int64) (oldCtl *Control, err error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
 	oldCtl, ok := cm.ctlsByRunId[runId]
 	if ok {
 		oldCtl.Replaced(ctl)
+	} else if maxClients > 0 && int64(len(cm.ctlsByRunId)) >= maxClients {
+		return nil, fmt.Errorf("too many clients, xfrps allows at most %d clients", maxClients)
 	}
 	cm.ctlsByRunId[runId] = ctl
 	return
 }
 
+// Del removes the control of client which is offline, nothing is removed if it was replaced by a new one.
+func (cm *ControlManager) Del(runId string, ctl *Control) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if c, ok := cm.ctlsByRunId[runId]; ok && c == ctl {
+		delete(cm.ctlsByRunId, runId)
+	}
+}
+
 func (cm *ControlManager) GetById(runId string) (ctl *Control, ok bool) {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
@@ -103,6 +414,122 @@ func (cm *ControlManager) GetById(runId string) (ctl *Control, ok bool) {
 	return
 }
 
+// BanManager keeps run ids which are not allowed to login.
+type BanManager struct {
+	// ban reasons indexed by run id
+	reasons map[string]string
+
+	// if store is nil, bans are only kept in memory
+	store BanStore
+
+	mu sync.RWMutex
+}
+
+func NewBanManager(store BanStore) (bm *BanManager, err error) {
+	bm = &BanManager{
+		reasons: make(map[string]string),
+		store:   store,
+	}
+	if store == nil {
+		return
+	}
+
+	snapshot, err := store.Load()
+	if err != nil {
+		return
+	}
+	bm.reasons = snapshot.Reasons
+	log.Info("load [%d] banned clients from ban store", len(bm.reasons))
+	return
+}
+
+func (bm *BanManager) Ban(runId string, reason string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.reasons[runId] = reason
+	bm.save()
+}
+
+// Unban returns false if runId is not banned.
+func (bm *BanManager) Unban(runId string) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	_, ok := bm.reasons[runId]
+	if ok {
+		delete(bm.reasons, runId)
+		bm.save()
+	}
+	return ok
+}
+
+// save must be called with bm.mu locked.
+func (bm *BanManager) save() {
+	if bm.store == nil {
+		return
+	}
+
+	snapshot := &BanSnapshot{
+		Version: BanStoreVersion,
+		Reasons: bm.reasons,
+	}
+	if err := bm.store.Save(snapshot); err != nil {
+		log.Warn("save banned clients error: %v", err)
+	}
+}
+
+func (bm *BanManager) IsBanned(runId string) (reason string, ok bool) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	reason, ok = bm.reasons[runId]
+	return
+}
+
+// GetAll returns a copy of ban reasons indexed by run id.
+func (bm *BanManager) GetAll() map[string]string {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	reasons := make(map[string]string, len(bm.reasons))
+	for runId, reason := range bm.reasons {
+		reasons[runId] = reason
+	}
+	return reasons
+}
+
+// IpConnManager counts user connections of every source ip.
+type IpConnManager struct {
+	counts map[string]int64
+
+	mu sync.Mutex
+}
+
+func NewIpConnManager() *IpConnManager {
+	return &IpConnManager{
+		counts: make(map[string]int64),
+	}
+}
+
+// Acquire counts a new connection from ip, it returns false if ip has maxConns connections already.
+// maxConns 0 means no limit.
+func (im *IpConnManager) Acquire(ip string, maxConns int64) bool {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if maxConns > 0 && im.counts[ip] >= maxConns {
+		return false
+	}
+	im.counts[ip]++
+	return true
+}
+
+func (im *IpConnManager) Release(ip string) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.counts[ip] <= 1 {
+		delete(im.counts, ip)
+	} else {
+		im.counts[ip]--
+	}
+}
+
 type ProxyManager struct {
 	// proxies indexed by proxy name
 	pxys map[string]Proxy
@@ -139,3 +566,13 @@ func (pm *ProxyManager) GetByName(name string) (pxy Proxy, ok bool) {
 	pxy, ok = pm.pxys[name]
 	return
 }
+
+func (pm *ProxyManager) GetAll() (pxys []Proxy) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	pxys = make([]Proxy, 0, len(pm.pxys))
+	for _, pxy := range pm.pxys {
+		pxys = append(pxys, pxy)
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/consts"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortManagerAlloc(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, err := NewPortManager(nil, [][2]int64{{20000, 20009}})
+	assert.NoError(err)
+
+	// every proxy of client gets its own port, and always gets the same one
+	sshPort, err := pm.Alloc("runid", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+	webPort, err := pm.Alloc("runid", "web", consts.TcpProxy)
+	assert.NoError(err)
+	assert.NotEqual(sshPort, webPort)
+	port, err := pm.Alloc("runid", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+	assert.Equal(sshPort, port)
+
+	// proxy with the same name of another client gets another port
+	port, err = pm.Alloc("other", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+	assert.NotEqual(sshPort, port)
+	assert.NotEqual(webPort, port)
+
+	// port is allocated again if proxy type is changed
+	port, err = pm.Alloc("runid", "ssh", consts.FtpProxy)
+	assert.NoError(err)
+	ftpPort, ok := pm.GetFtpById("runid")
+	assert.True(ok)
+	assert.Equal(port, ftpPort)
+	assert.Len(pm.GetProxyPorts("runid"), 2)
+}
+
+func TestPortManagerStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ports.json")
+
+	pm, err := NewPortManager(NewJsonPortStore(path), [][2]int64{{20000, 20009}})
+	assert.NoError(err)
+	sshPort, err := pm.Alloc("runid", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+	ftpPort, err := pm.Alloc("runid", "ftp", consts.FtpProxy)
+	assert.NoError(err)
+	pm.Online("runid")
+	pm.Flush()
+
+	// ports are loaded after restarting, loaded clients are offline
+	pm, err = NewPortManager(NewJsonPortStore(path), [][2]int64{{20000, 20009}})
+	assert.NoError(err)
+	port, err := pm.Alloc("runid", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+	assert.Equal(sshPort, port)
+	port, ok := pm.GetFtpById("runid")
+	assert.True(ok)
+	assert.Equal(ftpPort, port)
+	assert.NotZero(pm.records["runid"].OfflineTime)
+
+	// loaded ports are in use
+	_, err = pm.Acquire("other", sshPort)
+	assert.Error(err)
+
+	// ports not allowed any more are dropped
+	pm, err = NewPortManager(NewJsonPortStore(path), [][2]int64{{sshPort, sshPort}})
+	assert.NoError(err)
+	_, ok = pm.GetByName("runid", "ssh")
+	assert.True(ok)
+	_, ok = pm.GetByName("runid", "ftp")
+	assert.False(ok)
+
+	// unknown version is refused
+	assert.NoError(ioutil.WriteFile(path, []byte(`{"version":100,"records":{}}`), 0644))
+	_, err = NewPortManager(NewJsonPortStore(path), [][2]int64{{20000, 20009}})
+	assert.Error(err)
+}
+
+func TestPortManagerRealloc(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, err := NewPortManager(nil, [][2]int64{{20000, 20001}})
+	assert.NoError(err)
+	oldPort, err := pm.Alloc("runid", "ssh", consts.TcpProxy)
+	assert.NoError(err)
+
+	// old port is still in use, so the only other port is allocated
+	port, err := pm.Realloc("runid", "ssh", oldPort)
+	assert.NoError(err)
+	assert.NotEqual(oldPort, port)
+	allocated, ok := pm.GetByName("runid", "ssh")
+	assert.True(ok)
+	assert.Equal(port, allocated)
+
+	_, err = pm.Realloc("runid", "ssh", port)
+	assert.Error(err)
+	pm.Release(oldPort)
+	newPort, err := pm.Realloc("runid", "ssh", port)
+	assert.NoError(err)
+	assert.Equal(oldPort, newPort)
+
+	_, err = pm.Realloc("runid", "ssh", port)
+	assert.Error(err)
+}
+
+func TestAllocPortRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.GetDefaultServerCommonConf()
+	cfg.BindPort = 7000
+	cfg.VhostHttpPort = 7000
+	cfg.DashboardPort = 7500
+	cfg.PrivilegeAllowPorts = [][2]int64{{6999, 7001}, {7500, 7500}}
+	assert.Equal([][2]int64{{6999, 6999}, {7001, 7001}}, allocPortRanges(cfg))
+
+	cfg.PrivilegeAllowPorts = nil
+	assert.Equal([][2]int64{{minAllocPort, 6999}, {7001, 7499}, {7501, maxAllocPort}}, allocPortRanges(cfg))
+}
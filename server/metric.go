@@ -25,6 +25,9 @@ import (
 
 const (
 	ReserveDays = 7
+
+	// current rate of proxies is averaged over last seconds
+	RateSeconds = 5
 )
 
 var globalStats *ServerStatistics
@@ -34,6 +37,10 @@ type ServerStatistics struct {
 	TotalTrafficOut metric.DateCounter
 	CurConns        metric.Counter
 
+	// traffic since xfrps started
+	TrafficInTotal  metric.Counter
+	TrafficOutTotal metric.Counter
+
 	// counter for clients
 	ClientCounts metric.Counter
 
@@ -43,6 +50,19 @@ type ServerStatistics struct {
 	// counter for proxy types
 	ProxyTypeCounts map[string]metric.Counter
 
+	// user connections got work connections from pool or waited for them
+	PoolHits   metric.Counter
+	PoolMisses metric.Counter
+
+	// logins, proxies and user connections rejected by quotas
+	RejectedClients metric.Counter
+	RejectedProxies metric.Counter
+	RejectedConns   metric.Counter
+	RejectedIpConns metric.Counter
+
+	// user connections denied by allow_ips and deny_ips
+	DeniedConns metric.Counter
+
 	// statistics for different proxies
 	// key is proxy name
 	ProxyStatistics map[string]*ProxyStatistics
@@ -58,6 +78,9 @@ type ClientStatistics struct {
 	Online        int
 	ProxyNum      metric.Counter
 	ConnNum       metric.Counter
+	PoolSize      int64
+	PoolHits      metric.Counter
+	PoolMisses    metric.Counter
 	LastStartTime time.Time
 	LastCloseTime time.Time
 }
@@ -71,6 +94,20 @@ type ProxyStatistics struct {
 	CurConns      metric.Counter
 	LastStartTime time.Time
 	LastCloseTime time.Time
+
+	// traffic since xfrps started
+	TrafficInTotal  metric.Counter
+	TrafficOutTotal metric.Counter
+
+	// user connections rejected by max_conns_per_proxy and max_conns_per_ip
+	RejectedConns metric.Counter
+
+	// user connections denied by allow_ips and deny_ips
+	DeniedConns metric.Counter
+
+	// bytes per second
+	TrafficInRate  metric.RateCounter
+	TrafficOutRate metric.RateCounter
 }
 
 func init() {
@@ -78,12 +115,23 @@ func init() {
 		TotalTrafficIn:  metric.NewDateCounter(ReserveDays),
 		TotalTrafficOut: metric.NewDateCounter(ReserveDays),
 		CurConns:        metric.NewCounter(),
+		TrafficInTotal:  metric.NewCounter(),
+		TrafficOutTotal: metric.NewCounter(),
 
 		ClientCounts:        metric.NewCounter(),
 		OfflineClientCounts: metric.NewCounter(),
 
 		ProxyTypeCounts: make(map[string]metric.Counter),
 
+		PoolHits:   metric.NewCounter(),
+		PoolMisses: metric.NewCounter(),
+
+		RejectedClients: metric.NewCounter(),
+		RejectedProxies: metric.NewCounter(),
+		RejectedConns:   metric.NewCounter(),
+		RejectedIpConns: metric.NewCounter(),
+		DeniedConns:     metric.NewCounter(),
+
 		ProxyStatistics: make(map[string]*ProxyStatistics),
 
 		ClientStatistics: make(map[string]*ClientStatistics),
@@ -111,7 +159,7 @@ func StatsClearUselessInfo() {
 	}
 
 	for runid, data := range globalStats.ClientStatistics {
-		if !data.LastCloseTime.IsZero() && time.Since(data.LastCloseTime) > time.Duration(7*24)*time.Hour {
+		if data.Online == 0 && !data.LastCloseTime.IsZero() && time.Since(data.LastCloseTime) > time.Duration(7*24)*time.Hour {
 			globalStats.OfflineClientCounts.Dec(1)
 			delete(globalStats.ClientStatistics, runid)
 			log.Trace("clear client [%s]'s statistics data, lastCloseTime: [%s]", runid, data.LastCloseTime.String())
@@ -120,26 +168,34 @@ func StatsClearUselessInfo() {
 }
 
 func StatsNewClient(runid string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.ClientCounts.Inc(1)
 
 		globalStats.mu.Lock()
 		defer globalStats.mu.Unlock()
 		clientStats, ok := globalStats.ClientStatistics[runid]
 		if !ok {
-			clientStats = &ClientStatistics{
-				ProxyNum: metric.NewCounter(),
-				ConnNum:  metric.NewCounter(),
-			}
+			clientStats = newClientStatistics()
 			globalStats.ClientStatistics[runid] = clientStats
+		} else if clientStats.Online == 0 && !clientStats.LastCloseTime.IsZero() {
+			globalStats.OfflineClientCounts.Dec(1)
 		}
 		clientStats.LastStartTime = time.Now()
 		clientStats.Online = 1
 	}
 }
 
+func newClientStatistics() *ClientStatistics {
+	return &ClientStatistics{
+		ProxyNum:   metric.NewCounter(),
+		ConnNum:    metric.NewCounter(),
+		PoolHits:   metric.NewCounter(),
+		PoolMisses: metric.NewCounter(),
+	}
+}
+
 func StatsCloseClient(runid string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.ClientCounts.Dec(1)
 		globalStats.OfflineClientCounts.Inc(1)
 
@@ -155,7 +211,7 @@ func StatsCloseClient(runid string) {
 }
 
 func StatsNewProxy(name string, proxyType string, runid string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.mu.Lock()
 		defer globalStats.mu.Unlock()
 		counter, ok := globalStats.ProxyTypeCounts[proxyType]
@@ -172,22 +228,35 @@ func StatsNewProxy(name string, proxyType string, runid string) {
 
 		proxyStats, ok := globalStats.ProxyStatistics[name]
 		if !(ok && proxyStats.ProxyType == proxyType) {
-			proxyStats = &ProxyStatistics{
-				Name:       name,
-				RunId:      runid,
-				ProxyType:  proxyType,
-				CurConns:   metric.NewCounter(),
-				TrafficIn:  metric.NewDateCounter(ReserveDays),
-				TrafficOut: metric.NewDateCounter(ReserveDays),
-			}
+			proxyStats = newProxyStatistics(name, proxyType, runid)
 			globalStats.ProxyStatistics[name] = proxyStats
 		}
 		proxyStats.LastStartTime = time.Now()
 	}
 }
 
+func newProxyStatistics(name string, proxyType string, runid string) *ProxyStatistics {
+	return &ProxyStatistics{
+		Name:       name,
+		RunId:      runid,
+		ProxyType:  proxyType,
+		CurConns:   metric.NewCounter(),
+		TrafficIn:  metric.NewDateCounter(ReserveDays),
+		TrafficOut: metric.NewDateCounter(ReserveDays),
+
+		RejectedConns: metric.NewCounter(),
+		DeniedConns:   metric.NewCounter(),
+
+		TrafficInTotal:  metric.NewCounter(),
+		TrafficOutTotal: metric.NewCounter(),
+
+		TrafficInRate:  metric.NewRateCounter(RateSeconds),
+		TrafficOutRate: metric.NewRateCounter(RateSeconds),
+	}
+}
+
 func StatsCloseProxy(proxyName string, proxyType string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.mu.Lock()
 		defer globalStats.mu.Unlock()
 		if counter, ok := globalStats.ProxyTypeCounts[proxyType]; ok {
@@ -203,7 +272,7 @@ func StatsCloseProxy(proxyName string, proxyType string) {
 }
 
 func StatsOpenConnection(name string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.CurConns.Inc(1)
 
 		globalStats.mu.Lock()
@@ -220,7 +289,7 @@ func StatsOpenConnection(name string) {
 }
 
 func StatsCloseConnection(name string) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.CurConns.Dec(1)
 
 		globalStats.mu.Lock()
@@ -236,9 +305,97 @@ func StatsCloseConnection(name string) {
 	}
 }
 
+// StatsRejectClient counts a login rejected by max_clients.
+func StatsRejectClient() {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.RejectedClients.Inc(1)
+	}
+}
+
+// StatsRejectProxy counts a new proxy rejected by max_proxies_per_client.
+func StatsRejectProxy() {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.RejectedProxies.Inc(1)
+	}
+}
+
+// StatsRejectConn counts a user connection rejected by max_conns_per_proxy.
+func StatsRejectConn(name string) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.RejectedConns.Inc(1)
+		statsRejectProxyConn(name)
+	}
+}
+
+// StatsRejectIpConn counts a user connection rejected by max_conns_per_ip.
+func StatsRejectIpConn(name string) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.RejectedIpConns.Inc(1)
+		statsRejectProxyConn(name)
+	}
+}
+
+// StatsDenyConn counts a user connection denied by allow_ips and deny_ips.
+func StatsDenyConn(name string) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.DeniedConns.Inc(1)
+
+		globalStats.mu.Lock()
+		defer globalStats.mu.Unlock()
+		if proxyStats, ok := globalStats.ProxyStatistics[name]; ok {
+			proxyStats.DeniedConns.Inc(1)
+		}
+	}
+}
+
+func statsRejectProxyConn(name string) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+	if proxyStats, ok := globalStats.ProxyStatistics[name]; ok {
+		proxyStats.RejectedConns.Inc(1)
+	}
+}
+
+// StatsPoolHit counts a user connection which got a work connection from pool immediately.
+func StatsPoolHit(runid string) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.PoolHits.Inc(1)
+
+		globalStats.mu.Lock()
+		defer globalStats.mu.Unlock()
+		if clientStats, ok := globalStats.ClientStatistics[runid]; ok {
+			clientStats.PoolHits.Inc(1)
+		}
+	}
+}
+
+// StatsPoolMiss counts a user connection which waited for a work connection.
+func StatsPoolMiss(runid string) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.PoolMisses.Inc(1)
+
+		globalStats.mu.Lock()
+		defer globalStats.mu.Unlock()
+		if clientStats, ok := globalStats.ClientStatistics[runid]; ok {
+			clientStats.PoolMisses.Inc(1)
+		}
+	}
+}
+
+func StatsPoolSize(runid string, size int) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.mu.Lock()
+		defer globalStats.mu.Unlock()
+		if clientStats, ok := globalStats.ClientStatistics[runid]; ok {
+			clientStats.PoolSize = int64(size)
+		}
+	}
+}
+
 func StatsAddTrafficIn(name string, trafficIn int64) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.TotalTrafficIn.Inc(trafficIn)
+		globalStats.TrafficInTotal.Inc(trafficIn)
 
 		globalStats.mu.Lock()
 		defer globalStats.mu.Unlock()
@@ -246,14 +403,16 @@ func StatsAddTrafficIn(name string, trafficIn int64) {
 		proxyStats, ok := globalStats.ProxyStatistics[name]
 		if ok {
 			proxyStats.TrafficIn.Inc(trafficIn)
+			proxyStats.TrafficInTotal.Inc(trafficIn)
 			globalStats.ProxyStatistics[name] = proxyStats
 		}
 	}
 }
 
 func StatsAddTrafficOut(name string, trafficOut int64) {
-	if config.ServerCommonCfg.DashboardPort != 0 {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
 		globalStats.TotalTrafficOut.Inc(trafficOut)
+		globalStats.TrafficOutTotal.Inc(trafficOut)
 
 		globalStats.mu.Lock()
 		defer globalStats.mu.Unlock()
@@ -261,6 +420,7 @@ func StatsAddTrafficOut(name string, trafficOut int64) {
 		proxyStats, ok := globalStats.ProxyStatistics[name]
 		if ok {
 			proxyStats.TrafficOut.Inc(trafficOut)
+			proxyStats.TrafficOutTotal.Inc(trafficOut)
 			globalStats.ProxyStatistics[name] = proxyStats
 		}
 	}
@@ -274,6 +434,13 @@ type ServerStats struct {
 	ClientCounts        int64
 	OfflineClientCounts int64
 	ProxyTypeCounts     map[string]int64
+	PoolHits            int64
+	PoolMisses          int64
+	RejectedClients     int64
+	RejectedProxies     int64
+	RejectedConns       int64
+	RejectedIpConns     int64
+	DeniedConns         int64
 }
 
 func StatsGetServer() *ServerStats {
@@ -286,6 +453,13 @@ func StatsGetServer() *ServerStats {
 		ClientCounts:        globalStats.ClientCounts.Count(),
 		OfflineClientCounts: globalStats.OfflineClientCounts.Count(),
 		ProxyTypeCounts:     make(map[string]int64),
+		PoolHits:            globalStats.PoolHits.Count(),
+		PoolMisses:          globalStats.PoolMisses.Count(),
+		RejectedClients:     globalStats.RejectedClients.Count(),
+		RejectedProxies:     globalStats.RejectedProxies.Count(),
+		RejectedConns:       globalStats.RejectedConns.Count(),
+		RejectedIpConns:     globalStats.RejectedIpConns.Count(),
+		DeniedConns:         globalStats.DeniedConns.Count(),
 	}
 	for k, v := range globalStats.ProxyTypeCounts {
 		s.ProxyTypeCounts[k] = v.Count()
@@ -297,6 +471,9 @@ type ClientStats struct {
 	RunId         string
 	ProxyNum      int64
 	ConnNum       int64
+	PoolSize      int64
+	PoolHits      int64
+	PoolMisses    int64
 	LastStartTime string
 	LastCloseTime string
 }
@@ -313,9 +490,12 @@ func StatsGetClient(online int) []*ClientStats {
 		}
 
 		ps := &ClientStats{
-			RunId:    runid,
-			ProxyNum: clientStats.ProxyNum.Count(),
-			ConnNum:  clientStats.ConnNum.Count(),
+			RunId:      runid,
+			ProxyNum:   clientStats.ProxyNum.Count(),
+			ConnNum:    clientStats.ConnNum.Count(),
+			PoolSize:   clientStats.PoolSize,
+			PoolHits:   clientStats.PoolHits.Count(),
+			PoolMisses: clientStats.PoolMisses.Count(),
 		}
 		if !clientStats.LastStartTime.IsZero() {
 			ps.LastStartTime = clientStats.LastStartTime.Format("01-02 15:04:05")
@@ -337,6 +517,10 @@ type ProxyStats struct {
 	LastStartTime   string
 	LastCloseTime   string
 	CurConns        int64
+	InRate          int64
+	OutRate         int64
+	RejectedConns   int64
+	DeniedConns     int64
 }
 
 func StatsGetProxiesByType(proxyType string) []*ProxyStats {
@@ -356,6 +540,10 @@ func StatsGetProxiesByType(proxyType string) []*ProxyStats {
 			TodayTrafficIn:  proxyStats.TrafficIn.TodayCount(),
 			TodayTrafficOut: proxyStats.TrafficOut.TodayCount(),
 			CurConns:        proxyStats.CurConns.Count(),
+			InRate:          proxyStats.TrafficInRate.Rate(),
+			OutRate:         proxyStats.TrafficOutRate.Rate(),
+			RejectedConns:   proxyStats.RejectedConns.Count(),
+			DeniedConns:     proxyStats.DeniedConns.Count(),
 		}
 		if !proxyStats.LastStartTime.IsZero() {
 			ps.LastStartTime = proxyStats.LastStartTime.Format("01-02 15:04:05")
@@ -368,6 +556,19 @@ func StatsGetProxiesByType(proxyType string) []*ProxyStats {
 	return res
 }
 
+// StatsGetProxyRate returns rate counters of proxy which are increased during transferring,
+// they are nil if dashboard is disabled.
+func StatsGetProxyRate(name string) (inRate, outRate metric.RateCounter) {
+	if config.GetServerCommonCfg().DashboardPort != 0 {
+		globalStats.mu.Lock()
+		defer globalStats.mu.Unlock()
+		if proxyStats, ok := globalStats.ProxyStatistics[name]; ok {
+			inRate, outRate = proxyStats.TrafficInRate, proxyStats.TrafficOutRate
+		}
+	}
+	return
+}
+
 type ProxyTrafficInfo struct {
 	Name       string
 	TrafficIn  []int64
@@ -388,3 +589,82 @@ func StatsGetProxyTraffic(name string) (res *ProxyTrafficInfo) {
 	}
 	return
 }
+
+// StatsTakeSnapshot returns daily traffic and last start and close time of all proxies and clients for saving.
+func StatsTakeSnapshot() *StatsSnapshot {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	snapshot := &StatsSnapshot{
+		Version:    StatsStoreVersion,
+		SaveTime:   time.Now().Unix(),
+		TrafficIn:  globalStats.TotalTrafficIn.GetLastDaysCount(ReserveDays),
+		TrafficOut: globalStats.TotalTrafficOut.GetLastDaysCount(ReserveDays),
+		Proxies:    make(map[string]*ProxyStatsRecord),
+		Clients:    make(map[string]*ClientStatsRecord),
+	}
+	for name, proxyStats := range globalStats.ProxyStatistics {
+		snapshot.Proxies[name] = &ProxyStatsRecord{
+			RunId:         proxyStats.RunId,
+			ProxyType:     proxyStats.ProxyType,
+			TrafficIn:     proxyStats.TrafficIn.GetLastDaysCount(ReserveDays),
+			TrafficOut:    proxyStats.TrafficOut.GetLastDaysCount(ReserveDays),
+			LastStartTime: unixTime(proxyStats.LastStartTime),
+			LastCloseTime: unixTime(proxyStats.LastCloseTime),
+		}
+	}
+	for runId, clientStats := range globalStats.ClientStatistics {
+		snapshot.Clients[runId] = &ClientStatsRecord{
+			LastStartTime: unixTime(clientStats.LastStartTime),
+			LastCloseTime: unixTime(clientStats.LastCloseTime),
+		}
+	}
+	return snapshot
+}
+
+// StatsRestore loads statistics saved before restarting, it must be called before any client logins.
+// Proxies and clients which were online are closed at the time of snapshot.
+func StatsRestore(snapshot *StatsSnapshot) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	saveTime := time.Unix(snapshot.SaveTime, 0)
+	globalStats.TotalTrafficIn = metric.LoadDateCounter(ReserveDays, saveTime, snapshot.TrafficIn)
+	globalStats.TotalTrafficOut = metric.LoadDateCounter(ReserveDays, saveTime, snapshot.TrafficOut)
+	for name, record := range snapshot.Proxies {
+		proxyStats := newProxyStatistics(name, record.ProxyType, record.RunId)
+		proxyStats.TrafficIn = metric.LoadDateCounter(ReserveDays, saveTime, record.TrafficIn)
+		proxyStats.TrafficOut = metric.LoadDateCounter(ReserveDays, saveTime, record.TrafficOut)
+		proxyStats.LastStartTime = timeFromUnix(record.LastStartTime)
+		proxyStats.LastCloseTime = timeFromUnix(record.LastCloseTime)
+		if record.LastCloseTime < record.LastStartTime {
+			proxyStats.LastCloseTime = saveTime
+		}
+		globalStats.ProxyStatistics[name] = proxyStats
+	}
+	for runId, record := range snapshot.Clients {
+		clientStats := newClientStatistics()
+		clientStats.LastStartTime = timeFromUnix(record.LastStartTime)
+		clientStats.LastCloseTime = timeFromUnix(record.LastCloseTime)
+		if record.LastCloseTime < record.LastStartTime {
+			clientStats.LastCloseTime = saveTime
+		}
+		globalStats.ClientStatistics[runId] = clientStats
+		// restored clients are all offline until they login again
+		globalStats.OfflineClientCounts.Inc(1)
+	}
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeFromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PortStoreVersion = 1
+)
+
+// ProxyPort is the remote port allocated for one proxy.
+type ProxyPort struct {
+	ProxyName  string `json:"proxy_name"`
+	ProxyType  string `json:"proxy_type"`
+	Port       int64  `json:"port"`
+	CreateTime int64  `json:"create_time"`
+}
+
+// PortRecord is the ports allocated for one client.
+type PortRecord struct {
+	// indexed by proxy name
+	Ports map[string]*ProxyPort `json:"ports"`
+
+	// unix time when the client went offline, 0 means it is online
+	OfflineTime int64 `json:"offline_time"`
+}
+
+// PortSnapshot is all port allocations kept by PortManager, indexed by run id.
+type PortSnapshot struct {
+	Version int                    `json:"version"`
+	Records map[string]*PortRecord `json:"records"`
+}
+
+// PortStore saves port allocations so that clients get the same ports after xfrps restarts.
+type PortStore interface {
+	Load() (*PortSnapshot, error)
+	Save(*PortSnapshot) error
+}
+
+// JsonPortStore keeps port allocations in a json file.
+type JsonPortStore struct {
+	path string
+}
+
+func NewJsonPortStore(path string) *JsonPortStore {
+	return &JsonPortStore{
+		path: path,
+	}
+}
+
+// Load returns an empty snapshot if the file doesn't exist yet.
+func (s *JsonPortStore) Load() (snapshot *PortSnapshot, err error) {
+	snapshot = &PortSnapshot{
+		Version: PortStoreVersion,
+		Records: make(map[string]*PortRecord),
+	}
+
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(buf, snapshot); err != nil {
+		err = fmt.Errorf("parse port store file [%s] error: %v", s.path, err)
+		return
+	}
+	if snapshot.Version != PortStoreVersion {
+		err = fmt.Errorf("port store file [%s] version [%d] is not supported", s.path, snapshot.Version)
+		return
+	}
+	if snapshot.Records == nil {
+		snapshot.Records = make(map[string]*PortRecord)
+	}
+	for _, record := range snapshot.Records {
+		if record.Ports == nil {
+			record.Ports = make(map[string]*ProxyPort)
+		}
+	}
+	return
+}
+
+func (s *JsonPortStore) Save(snapshot *PortSnapshot) error {
+	return saveJsonFile(s.path, snapshot)
+}
+
+// saveJsonFile writes to a temporary file first, so a crash never leaves a broken file behind.
+func saveJsonFile(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(buf); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
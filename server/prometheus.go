@@ -0,0 +1,176 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/utils/log"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// /metrics
+func apiMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Debug("Http request: [/metrics]")
+	if !config.GetServerCommonCfg().EnablePrometheus {
+		http.NotFound(w, r)
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writePrometheusMetrics(buf)
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(buf.Bytes())
+}
+
+// prometheusAuth checks prometheus_user and prometheus_pwd, dashboard_user and dashboard_pwd are checked instead if both are empty.
+func prometheusAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if checkPrometheusAuth(r) {
+			h(w, r, ps)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+	}
+}
+
+func checkPrometheusAuth(r *http.Request) bool {
+	cfg := config.GetServerCommonCfg()
+	if cfg.PrometheusUser == "" && cfg.PrometheusPwd == "" {
+		return checkBasicAuth(r, ScopeRead)
+	}
+	user, passwd, hasAuth := r.BasicAuth()
+	return hasAuth &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(cfg.PrometheusUser)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(passwd), []byte(cfg.PrometheusPwd)) == 1
+}
+
+// writePrometheusMetrics writes statistics in prometheus text format.
+func writePrometheusMetrics(w io.Writer) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	writeMetricHeader(w, "xfrps_traffic_in_bytes_total", "counter", "Bytes from users to all proxies since xfrps started.")
+	fmt.Fprintf(w, "xfrps_traffic_in_bytes_total %d\n", globalStats.TrafficInTotal.Count())
+	writeMetricHeader(w, "xfrps_traffic_out_bytes_total", "counter", "Bytes from all proxies to users since xfrps started.")
+	fmt.Fprintf(w, "xfrps_traffic_out_bytes_total %d\n", globalStats.TrafficOutTotal.Count())
+	writeMetricHeader(w, "xfrps_connections", "gauge", "Current user connections of all proxies.")
+	fmt.Fprintf(w, "xfrps_connections %d\n", globalStats.CurConns.Count())
+
+	var online, offline int64
+	for _, clientStats := range globalStats.ClientStatistics {
+		if clientStats.Online == 1 {
+			online++
+		} else {
+			offline++
+		}
+	}
+	writeMetricHeader(w, "xfrps_clients", "gauge", "Clients online and offline.")
+	fmt.Fprintf(w, "xfrps_clients{status=\"online\"} %d\n", online)
+	fmt.Fprintf(w, "xfrps_clients{status=\"offline\"} %d\n", offline)
+
+	proxyTypes := make([]string, 0, len(globalStats.ProxyTypeCounts))
+	for proxyType := range globalStats.ProxyTypeCounts {
+		proxyTypes = append(proxyTypes, proxyType)
+	}
+	sort.Strings(proxyTypes)
+	writeMetricHeader(w, "xfrps_proxies", "gauge", "Running proxies by type.")
+	for _, proxyType := range proxyTypes {
+		fmt.Fprintf(w, "xfrps_proxies{type=\"%s\"} %d\n", escapeLabelValue(proxyType), globalStats.ProxyTypeCounts[proxyType].Count())
+	}
+
+	writeMetricHeader(w, "xfrps_pool_hits_total", "counter", "User connections got work connections from pool immediately.")
+	fmt.Fprintf(w, "xfrps_pool_hits_total %d\n", globalStats.PoolHits.Count())
+	writeMetricHeader(w, "xfrps_pool_misses_total", "counter", "User connections waited for work connections.")
+	fmt.Fprintf(w, "xfrps_pool_misses_total %d\n", globalStats.PoolMisses.Count())
+
+	writeMetricHeader(w, "xfrps_rejected_total", "counter", "Logins, proxies and user connections rejected by quotas.")
+	fmt.Fprintf(w, "xfrps_rejected_total{quota=\"max_clients\"} %d\n", globalStats.RejectedClients.Count())
+	fmt.Fprintf(w, "xfrps_rejected_total{quota=\"max_proxies_per_client\"} %d\n", globalStats.RejectedProxies.Count())
+	fmt.Fprintf(w, "xfrps_rejected_total{quota=\"max_conns_per_proxy\"} %d\n", globalStats.RejectedConns.Count())
+	fmt.Fprintf(w, "xfrps_rejected_total{quota=\"max_conns_per_ip\"} %d\n", globalStats.RejectedIpConns.Count())
+	writeMetricHeader(w, "xfrps_denied_connections_total", "counter", "User connections denied by allow_ips and deny_ips.")
+	fmt.Fprintf(w, "xfrps_denied_connections_total %d\n", globalStats.DeniedConns.Count())
+
+	runIds := make([]string, 0, len(globalStats.ClientStatistics))
+	for runId := range globalStats.ClientStatistics {
+		runIds = append(runIds, runId)
+	}
+	sort.Strings(runIds)
+	writeMetricHeader(w, "xfrps_client_online", "gauge", "1 if the client is online.")
+	for _, runId := range runIds {
+		fmt.Fprintf(w, "xfrps_client_online{runid=\"%s\"} %d\n", escapeLabelValue(runId), globalStats.ClientStatistics[runId].Online)
+	}
+	writeMetricHeader(w, "xfrps_client_proxies", "gauge", "Running proxies of the client.")
+	for _, runId := range runIds {
+		fmt.Fprintf(w, "xfrps_client_proxies{runid=\"%s\"} %d\n", escapeLabelValue(runId), globalStats.ClientStatistics[runId].ProxyNum.Count())
+	}
+	writeMetricHeader(w, "xfrps_client_connections", "gauge", "Current user connections of the client.")
+	for _, runId := range runIds {
+		fmt.Fprintf(w, "xfrps_client_connections{runid=\"%s\"} %d\n", escapeLabelValue(runId), globalStats.ClientStatistics[runId].ConnNum.Count())
+	}
+
+	names := make([]string, 0, len(globalStats.ProxyStatistics))
+	for name := range globalStats.ProxyStatistics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	proxyMetrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(*ProxyStatistics) int64
+	}{
+		{"xfrps_proxy_traffic_in_bytes_total", "counter", "Bytes from users to the proxy since xfrps started.",
+			func(ps *ProxyStatistics) int64 { return ps.TrafficInTotal.Count() }},
+		{"xfrps_proxy_traffic_out_bytes_total", "counter", "Bytes from the proxy to users since xfrps started.",
+			func(ps *ProxyStatistics) int64 { return ps.TrafficOutTotal.Count() }},
+		{"xfrps_proxy_connections", "gauge", "Current user connections of the proxy.",
+			func(ps *ProxyStatistics) int64 { return ps.CurConns.Count() }},
+		{"xfrps_proxy_traffic_in_rate_bytes", "gauge", "Bytes per second from users to the proxy.",
+			func(ps *ProxyStatistics) int64 { return ps.TrafficInRate.Rate() }},
+		{"xfrps_proxy_traffic_out_rate_bytes", "gauge", "Bytes per second from the proxy to users.",
+			func(ps *ProxyStatistics) int64 { return ps.TrafficOutRate.Rate() }},
+	}
+	for _, m := range proxyMetrics {
+		writeMetricHeader(w, m.name, m.kind, m.help)
+		for _, name := range names {
+			ps := globalStats.ProxyStatistics[name]
+			fmt.Fprintf(w, "%s{name=\"%s\",type=\"%s\",runid=\"%s\"} %d\n", m.name,
+				escapeLabelValue(name), escapeLabelValue(ps.ProxyType), escapeLabelValue(ps.RunId), m.value(ps))
+		}
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
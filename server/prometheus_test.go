@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/consts"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("ssh", escapeLabelValue("ssh"))
+	assert.Equal(`a\\b\"c\nd`, escapeLabelValue("a\\b\"c\nd"))
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.GetDefaultServerCommonConf()
+	cfg.DashboardPort = 7500
+	config.SetServerCommonCfg(cfg)
+
+	StatsNewClient("prom\"runid")
+	StatsNewProxy("prom_ssh", consts.TcpProxy, "prom\"runid")
+	defer func() {
+		StatsCloseConnection("prom_ssh")
+		StatsCloseProxy("prom_ssh", consts.TcpProxy)
+		StatsCloseClient("prom\"runid")
+		globalStats.mu.Lock()
+		delete(globalStats.ProxyStatistics, "prom_ssh")
+		delete(globalStats.ClientStatistics, "prom\"runid")
+		globalStats.mu.Unlock()
+	}()
+	StatsOpenConnection("prom_ssh")
+	StatsAddTrafficIn("prom_ssh", 100)
+	StatsAddTrafficOut("prom_ssh", 200)
+
+	buf := bytes.NewBuffer(nil)
+	writePrometheusMetrics(buf)
+	out := buf.String()
+
+	assert.Contains(out, "# HELP xfrps_proxy_connections Current user connections of the proxy.\n# TYPE xfrps_proxy_connections gauge\n")
+	assert.Contains(out, "xfrps_client_online{runid=\"prom\\\"runid\"} 1\n")
+	assert.Contains(out, "xfrps_client_proxies{runid=\"prom\\\"runid\"} 1\n")
+	assert.Contains(out, "xfrps_proxy_connections{name=\"prom_ssh\",type=\"tcp\",runid=\"prom\\\"runid\"} 1\n")
+	assert.Contains(out, "xfrps_proxy_traffic_in_bytes_total{name=\"prom_ssh\",type=\"tcp\",runid=\"prom\\\"runid\"} 100\n")
+	assert.Contains(out, "xfrps_proxy_traffic_out_bytes_total{name=\"prom_ssh\",type=\"tcp\",runid=\"prom\\\"runid\"} 200\n")
+	assert.Contains(out, "xfrps_proxies{type=\"tcp\"} ")
+}
+
+func TestCheckPrometheusAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.GetDefaultServerCommonConf()
+	cfg.DashboardUser = "ops"
+	cfg.DashboardPwd = "secret"
+	config.SetServerCommonCfg(cfg)
+
+	// dashboard's user and password are used if prometheus ones are empty
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	assert.False(checkPrometheusAuth(r))
+	r.SetBasicAuth("ops", "secret")
+	assert.True(checkPrometheusAuth(r))
+
+	cfg.PrometheusUser = "prometheus"
+	cfg.PrometheusPwd = "scrape"
+	assert.False(checkPrometheusAuth(r))
+	r.SetBasicAuth("prometheus", "scrape")
+	assert.True(checkPrometheusAuth(r))
+}
@@ -19,16 +19,24 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/consts"
 	"github.com/liudf0716/xfrps/models/msg"
+	plugin "github.com/liudf0716/xfrps/models/plugin/server"
 	"github.com/liudf0716/xfrps/models/proto/tcp"
 	"github.com/liudf0716/xfrps/models/proto/udp"
 	"github.com/liudf0716/xfrps/utils/errors"
+	"github.com/liudf0716/xfrps/utils/limit"
 	"github.com/liudf0716/xfrps/utils/log"
+	"github.com/liudf0716/xfrps/utils/metric"
 	frpNet "github.com/liudf0716/xfrps/utils/net"
+	"github.com/liudf0716/xfrps/utils/util"
 	"github.com/liudf0716/xfrps/utils/vhost"
 )
 
@@ -39,6 +47,7 @@ type Proxy interface {
 	GetConf() config.ProxyConf
 	GetWorkConnFromPool() (workConn frpNet.Conn, err error)
 	GetRemotePort() int64
+	GetLimiters() (inLimiters, outLimiters []*limit.Limiter)
 	Close()
 	log.Logger
 }
@@ -47,7 +56,19 @@ type BaseProxy struct {
 	name      string
 	ctl       *Control
 	listeners []frpNet.Listener
-	mu        sync.RWMutex
+
+	// bandwidth of this proxy, nil means no limit
+	inLimiter  *limit.Limiter
+	outLimiter *limit.Limiter
+
+	// current user connections, limited by max_conns_per_proxy
+	curConns int64
+
+	// source ips of user connections, empty allowIps means all
+	allowIps []*net.IPNet
+	denyIps  []*net.IPNet
+
+	mu sync.RWMutex
 	log.Logger
 }
 
@@ -59,6 +80,13 @@ func (pxy *BaseProxy) GetControl() *Control {
 	return pxy.ctl
 }
 
+// GetLimiters returns limiters of this proxy and its client, traffic must pass all of them.
+func (pxy *BaseProxy) GetLimiters() (inLimiters, outLimiters []*limit.Limiter) {
+	inLimiters = []*limit.Limiter{pxy.inLimiter, pxy.ctl.inLimiter}
+	outLimiters = []*limit.Limiter{pxy.outLimiter, pxy.ctl.outLimiter}
+	return
+}
+
 func (pxy *BaseProxy) Close() {
 	pxy.Info("proxy closing")
 	for _, l := range pxy.listeners {
@@ -66,6 +94,14 @@ func (pxy *BaseProxy) Close() {
 	}
 }
 
+// closeListeners closes listeners registered by Run, it's called if Run fails halfway.
+func (pxy *BaseProxy) closeListeners() {
+	for _, l := range pxy.listeners {
+		l.Close()
+	}
+	pxy.listeners = pxy.listeners[:0]
+}
+
 func (pxy *BaseProxy) GetWorkConnFromPool() (workConn frpNet.Conn, err error) {
 	ctl := pxy.GetControl()
 	// try all connections from the pool
@@ -75,7 +111,7 @@ func (pxy *BaseProxy) GetWorkConnFromPool() (workConn frpNet.Conn, err error) {
 			return
 		}
 		pxy.Info("get a new work connection: [%s]", workConn.RemoteAddr().String())
-		workConn.AddLogPrefix(pxy.GetName())
+		workConn.AddLogField(log.FieldProxy, pxy.GetName())
 
 		err := msg.WriteMsg(workConn, &msg.StartWorkConn{
 			ProxyName: pxy.GetName(),
@@ -110,18 +146,148 @@ func (pxy *BaseProxy) startListenHandler(p Proxy, handler func(Proxy, frpNet.Con
 					return
 				}
 				pxy.Debug("get a user connection [%s]", c.RemoteAddr().String())
-				go handler(p, c)
+				if !pxy.acquireConn(c) {
+					c.Close()
+					continue
+				}
+				go func() {
+					defer pxy.releaseConn(c)
+					handler(p, c)
+				}()
 			}
 		}(listener)
 	}
 }
 
+// listenPort listens on remote port of tcp or ftp proxy. If the port was allocated by xfrps for this proxy
+// and it can't be listened, for example another process has taken it, another port is allocated,
+// so reconnecting clients don't retry the same dead port. port is changed to the new one.
+// Ports failed to be listened are kept in use until retrying is over, so they are not allocated again.
+// acquiredPort is the port specified by client and acquired for this proxy, it's never replaced.
+func (pxy *BaseProxy) listenPort(port *int64, acquiredPort int64) (listener frpNet.Listener, err error) {
+	bindAddr := config.GetServerCommonCfg().BindAddr
+	listener, err = frpNet.ListenTcp(bindAddr, *port)
+	if err == nil || acquiredPort != 0 {
+		return
+	}
+
+	pm := pxy.ctl.svr.portManager
+	var failedPorts []int64
+	defer func() {
+		for _, p := range failedPorts {
+			pm.Release(p)
+		}
+	}()
+	for i := 0; i < maxAllocRetries; i++ {
+		if allocated, ok := pm.GetByName(pxy.ctl.runId, pxy.name); !ok || allocated != *port {
+			return
+		}
+		pxy.Warn("listen allocated port [%d] error: %v, allocate another one", *port, err)
+		newPort, errRet := pm.Realloc(pxy.ctl.runId, pxy.name, *port)
+		if errRet != nil {
+			err = errRet
+			return
+		}
+		failedPorts = append(failedPorts, *port)
+		*port = newPort
+		if listener, err = frpNet.ListenTcp(bindAddr, *port); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// acquireConn checks source ip and quotas before handling user connection.
+func (pxy *BaseProxy) acquireConn(c frpNet.Conn) bool {
+	cfg := config.GetServerCommonCfg()
+	if err := pxy.checkIp(cfg, net.ParseIP(remoteIp(c))); err != nil {
+		pxy.Warn("user connection [%s] denied, %v", c.RemoteAddr().String(), err)
+		StatsDenyConn(pxy.name)
+		return false
+	}
+
+	pxy.mu.Lock()
+	if cfg.MaxConnsPerProxy > 0 && pxy.curConns >= cfg.MaxConnsPerProxy {
+		pxy.mu.Unlock()
+		pxy.Warn("user connection [%s] rejected, proxy has %d connections already", c.RemoteAddr().String(), cfg.MaxConnsPerProxy)
+		StatsRejectConn(pxy.name)
+		return false
+	}
+	pxy.curConns++
+	pxy.mu.Unlock()
+
+	if !pxy.ctl.svr.ipConnManager.Acquire(remoteIp(c), cfg.MaxConnsPerIp) {
+		pxy.mu.Lock()
+		pxy.curConns--
+		pxy.mu.Unlock()
+		pxy.Warn("user connection [%s] rejected, its ip has %d connections already", c.RemoteAddr().String(), cfg.MaxConnsPerIp)
+		StatsRejectIpConn(pxy.name)
+		return false
+	}
+	return true
+}
+
+// checkIp checks ip with policy of server first, proxy can't allow ips not allowed by server.
+func (pxy *BaseProxy) checkIp(cfg *config.ServerCommonConf, ip net.IP) error {
+	if ip == nil {
+		if len(cfg.AllowIps) > 0 || len(pxy.allowIps) > 0 {
+			return fmt.Errorf("unknown source ip")
+		}
+		return nil
+	}
+	if util.ContainsIp(cfg.DenyIps, ip) {
+		return fmt.Errorf("ip is in deny_ips of server")
+	}
+	if len(cfg.AllowIps) > 0 && !util.ContainsIp(cfg.AllowIps, ip) {
+		return fmt.Errorf("ip is not in allow_ips of server")
+	}
+	if util.ContainsIp(pxy.denyIps, ip) {
+		return fmt.Errorf("ip is in deny_ips of proxy")
+	}
+	if len(pxy.allowIps) > 0 && !util.ContainsIp(pxy.allowIps, ip) {
+		return fmt.Errorf("ip is not in allow_ips of proxy")
+	}
+	return nil
+}
+
+func (pxy *BaseProxy) releaseConn(c frpNet.Conn) {
+	pxy.ctl.svr.ipConnManager.Release(remoteIp(c))
+	pxy.mu.Lock()
+	pxy.curConns--
+	pxy.mu.Unlock()
+}
+
+func remoteIp(c frpNet.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 func NewProxy(ctl *Control, pxyConf config.ProxyConf) (pxy Proxy, err error) {
+	baseCfg := pxyConf.GetBaseInfo()
+	rate, err := limit.ParseBandwidth(baseCfg.BandwidthLimit)
+	if err != nil {
+		return pxy, err
+	}
+	allowIps, err := util.GetIpNets(strings.Join(baseCfg.AllowIps, ","))
+	if err != nil {
+		return pxy, fmt.Errorf("allow_ips is incorrect, %v", err)
+	}
+	denyIps, err := util.GetIpNets(strings.Join(baseCfg.DenyIps, ","))
+	if err != nil {
+		return pxy, fmt.Errorf("deny_ips is incorrect, %v", err)
+	}
 	basePxy := BaseProxy{
-		name:      pxyConf.GetName(),
-		ctl:       ctl,
-		listeners: make([]frpNet.Listener, 0),
-		Logger:    log.NewPrefixLogger(ctl.runId),
+		name:       pxyConf.GetName(),
+		ctl:        ctl,
+		listeners:  make([]frpNet.Listener, 0),
+		inLimiter:  limit.NewLimiter(rate),
+		outLimiter: limit.NewLimiter(rate),
+		allowIps:   allowIps,
+		denyIps:    denyIps,
+		Logger:     log.NewFieldLogger(log.FieldRunId, ctl.runId),
 	}
 	switch cfg := pxyConf.(type) {
 	case *config.TcpProxyConf:
@@ -148,30 +314,39 @@ func NewProxy(ctl *Control, pxyConf config.ProxyConf) (pxy Proxy, err error) {
 		pxy = &UdpProxy{
 			BaseProxy: basePxy,
 			cfg:       cfg,
+			users:     make(map[string]*udpUser),
 		}
 	default:
 		return pxy, fmt.Errorf("proxy type not support")
 	}
-	pxy.AddLogPrefix(pxy.GetName())
+	pxy.AddLogField(log.FieldProxy, pxy.GetName())
 	return
 }
 
 type TcpProxy struct {
 	BaseProxy
 	cfg *config.TcpProxyConf
+
+	// remote port specified by client, released when proxy closed
+	acquiredPort int64
 }
 
-func (pxy *TcpProxy) Run() error {
+func (pxy *TcpProxy) Run() (err error) {
 	if pxy.cfg.RemotePort == 0 {
 		// get port for client
-		pxy.cfg.RemotePort = pxy.ctl.GetFreePort()
+		if pxy.cfg.RemotePort, err = pxy.ctl.GetFreePort(pxy.name, consts.TcpProxy); err != nil {
+			return
+		}
+	} else if pxy.acquiredPort, err = pxy.ctl.AcquirePort(pxy.cfg.RemotePort); err != nil {
+		return
 	}
 
-	listener, err := frpNet.ListenTcp(config.ServerCommonCfg.BindAddr, pxy.cfg.RemotePort)
+	listener, err := pxy.listenPort(&pxy.cfg.RemotePort, pxy.acquiredPort)
 	if err != nil {
+		pxy.releasePort()
 		return err
 	}
-	listener.AddLogPrefix(pxy.name)
+	listener.AddLogField(log.FieldProxy, pxy.name)
 	pxy.listeners = append(pxy.listeners, listener)
 	pxy.Info("tcp proxy [%s] listen port [%d]", pxy.name, pxy.cfg.RemotePort)
 
@@ -184,34 +359,44 @@ func (pxy *TcpProxy) GetConf() config.ProxyConf {
 }
 
 func (pxy *TcpProxy) GetRemotePort() int64 {
-	if pxy.cfg.RemotePort == 0 {
-		// get port for client
-		pxy.cfg.RemotePort = pxy.ctl.GetFreePort()
-	}
-
 	return pxy.cfg.RemotePort
 }
 
 func (pxy *TcpProxy) Close() {
 	pxy.BaseProxy.Close()
+	pxy.releasePort()
+}
+
+func (pxy *TcpProxy) releasePort() {
+	pxy.ctl.ReleasePort(pxy.acquiredPort)
+	pxy.acquiredPort = 0
 }
 
 // ftp proxy
 type FtpProxy struct {
 	BaseProxy
 	cfg *config.FtpProxyConf
+
+	// remote port specified by client, released when proxy closed
+	acquiredPort int64
 }
 
-func (pxy *FtpProxy) Run() error {
+func (pxy *FtpProxy) Run() (err error) {
 	if pxy.cfg.RemotePort == 0 {
-		pxy.cfg.RemotePort = pxy.ctl.GetFtpPort()
+		if pxy.cfg.RemotePort, err = pxy.ctl.GetFreePort(pxy.name, consts.FtpProxy); err != nil {
+			return
+		}
+	} else if pxy.acquiredPort, err = pxy.ctl.AcquirePort(pxy.cfg.RemotePort); err != nil {
+		return
 	}
-	listener, err := frpNet.ListenTcp(config.ServerCommonCfg.BindAddr, pxy.cfg.RemotePort)
+
+	listener, err := pxy.listenPort(&pxy.cfg.RemotePort, pxy.acquiredPort)
 	if err != nil {
+		pxy.releasePort()
 		return err
 	}
 
-	listener.AddLogPrefix(pxy.name)
+	listener.AddLogField(log.FieldProxy, pxy.name)
 	pxy.listeners = append(pxy.listeners, listener)
 	pxy.Info("ftp proxy [%s] control listen port [%d] ", pxy.name, pxy.cfg.RemotePort)
 
@@ -224,16 +409,17 @@ func (pxy *FtpProxy) GetConf() config.ProxyConf {
 }
 
 func (pxy *FtpProxy) GetRemotePort() int64 {
-	if pxy.cfg.RemotePort == 0 {
-		// get port for client
-		pxy.cfg.RemotePort = pxy.ctl.GetFtpPort()
-	}
-
 	return pxy.cfg.RemotePort
 }
 
 func (pxy *FtpProxy) Close() {
 	pxy.BaseProxy.Close()
+	pxy.releasePort()
+}
+
+func (pxy *FtpProxy) releasePort() {
+	pxy.ctl.ReleasePort(pxy.acquiredPort)
+	pxy.acquiredPort = 0
 }
 
 type HttpProxy struct {
@@ -247,6 +433,11 @@ func (pxy *HttpProxy) Run() (err error) {
 		Username:    pxy.cfg.HttpUser,
 		Password:    pxy.cfg.HttpPwd,
 	}
+	defer func() {
+		if err != nil {
+			pxy.closeListeners()
+		}
+	}()
 
 	locations := pxy.cfg.Locations
 	if len(locations) == 0 {
@@ -260,21 +451,21 @@ func (pxy *HttpProxy) Run() (err error) {
 			if err != nil {
 				return err
 			}
-			l.AddLogPrefix(pxy.name)
+			l.AddLogField(log.FieldProxy, pxy.name)
 			pxy.Info("http proxy listen for host [%s] location [%s]", routeConfig.Domain, routeConfig.Location)
 			pxy.listeners = append(pxy.listeners, l)
 		}
 	}
 
 	if pxy.cfg.SubDomain != "" {
-		routeConfig.Domain = pxy.cfg.SubDomain + "." + config.ServerCommonCfg.SubDomainHost
+		routeConfig.Domain = pxy.cfg.SubDomain + "." + config.GetServerCommonCfg().SubDomainHost
 		for _, location := range locations {
 			routeConfig.Location = location
 			l, err := pxy.ctl.svr.VhostHttpMuxer.Listen(routeConfig)
 			if err != nil {
 				return err
 			}
-			l.AddLogPrefix(pxy.name)
+			l.AddLogField(log.FieldProxy, pxy.name)
 			pxy.Info("http proxy listen for host [%s] location [%s]", routeConfig.Domain, routeConfig.Location)
 			pxy.listeners = append(pxy.listeners, l)
 		}
@@ -303,6 +494,11 @@ type HttpsProxy struct {
 
 func (pxy *HttpsProxy) Run() (err error) {
 	routeConfig := &vhost.VhostRouteConfig{}
+	defer func() {
+		if err != nil {
+			pxy.closeListeners()
+		}
+	}()
 
 	for _, domain := range pxy.cfg.CustomDomains {
 		routeConfig.Domain = domain
@@ -310,18 +506,18 @@ func (pxy *HttpsProxy) Run() (err error) {
 		if err != nil {
 			return err
 		}
-		l.AddLogPrefix(pxy.name)
+		l.AddLogField(log.FieldProxy, pxy.name)
 		pxy.Info("https proxy listen for host [%s]", routeConfig.Domain)
 		pxy.listeners = append(pxy.listeners, l)
 	}
 
 	if pxy.cfg.SubDomain != "" {
-		routeConfig.Domain = pxy.cfg.SubDomain + "." + config.ServerCommonCfg.SubDomainHost
+		routeConfig.Domain = pxy.cfg.SubDomain + "." + config.GetServerCommonCfg().SubDomainHost
 		l, err := pxy.ctl.svr.VhostHttpsMuxer.Listen(routeConfig)
 		if err != nil {
 			return err
 		}
-		l.AddLogPrefix(pxy.name)
+		l.AddLogField(log.FieldProxy, pxy.name)
 		pxy.Info("https proxy listen for host [%s]", routeConfig.Domain)
 		pxy.listeners = append(pxy.listeners, l)
 	}
@@ -362,11 +558,21 @@ type UdpProxy struct {
 	// checkCloseCh is used for watching if workConn is closed
 	checkCloseCh chan int
 
+	// denied packets since lastDenyLog, only used by the goroutine reading packets from users
+	deniedPackets int64
+	lastDenyLog   time.Time
+
+	// users are source addresses of udp packets checked by plugins, indexed by address.
+	// They are like user connections, checked again after idle for udpUserTimeout.
+	users     map[string]*udpUser
+	lastSweep time.Time
+	usersMu   sync.Mutex
+
 	isClosed bool
 }
 
 func (pxy *UdpProxy) Run() (err error) {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", config.ServerCommonCfg.BindAddr, pxy.cfg.RemotePort))
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", config.GetServerCommonCfg().BindAddr, pxy.cfg.RemotePort))
 	if err != nil {
 		return err
 	}
@@ -382,8 +588,10 @@ func (pxy *UdpProxy) Run() (err error) {
 	pxy.readCh = make(chan *msg.UdpPacket, 1024)
 	pxy.checkCloseCh = make(chan int)
 
+	inLimiters, outLimiters := pxy.GetLimiters()
+
 	// read message from workConn, if it returns any error, notify proxy to start a new workConn
-	workConnReaderFn := func(conn net.Conn) {
+	workConnReaderFn := func(conn net.Conn, outRate metric.RateCounter) {
 		for {
 			var (
 				rawMsg msg.Message
@@ -408,6 +616,10 @@ func (pxy *UdpProxy) Run() (err error) {
 				pxy.Trace("udp work conn get ping message")
 				continue
 			case *msg.UdpPacket:
+				waitLimiters(outLimiters, len(m.Content))
+				if outRate != nil {
+					outRate.Inc(int64(len(m.Content)))
+				}
 				if errRet := errors.PanicToError(func() {
 					pxy.Trace("get udp message from workConn: %s", m.Content)
 					pxy.readCh <- m
@@ -422,7 +634,7 @@ func (pxy *UdpProxy) Run() (err error) {
 	}
 
 	// send message to workConn
-	workConnSenderFn := func(conn net.Conn, ctx context.Context) {
+	workConnSenderFn := func(conn net.Conn, ctx context.Context, inRate metric.RateCounter) {
 		var errRet error
 		for {
 			select {
@@ -431,6 +643,10 @@ func (pxy *UdpProxy) Run() (err error) {
 					pxy.Info("sender goroutine for udp work connection closed")
 					return
 				}
+				waitLimiters(inLimiters, len(udpMsg.Content))
+				if inRate != nil {
+					inRate.Inc(int64(len(udpMsg.Content)))
+				}
 				if errRet = msg.WriteMsg(conn, udpMsg); errRet != nil {
 					pxy.Info("sender goroutine for udp work connection closed: %v", errRet)
 					conn.Close()
@@ -470,8 +686,9 @@ func (pxy *UdpProxy) Run() (err error) {
 			}
 			pxy.workConn = workConn
 			ctx, cancel := context.WithCancel(context.Background())
-			go workConnReaderFn(workConn)
-			go workConnSenderFn(workConn, ctx)
+			inRate, outRate := StatsGetProxyRate(pxy.GetName())
+			go workConnReaderFn(workConn, outRate)
+			go workConnSenderFn(workConn, ctx, inRate)
 			_, ok := <-pxy.checkCloseCh
 			cancel()
 			if !ok {
@@ -485,12 +702,79 @@ func (pxy *UdpProxy) Run() (err error) {
 	// Response will be wrapped to be forwarded by work connection to server.
 	// Close readCh and sendCh at the end.
 	go func() {
-		udp.ForwardUserConn(udpConn, pxy.readCh, pxy.sendCh)
+		udp.ForwardUserConn(udpConn, pxy.readCh, pxy.sendCh, pxy.acceptPacket)
 		pxy.Close()
 	}()
 	return nil
 }
 
+// acceptPacket checks udp packets from users by source ip and plugins like tcp user connections.
+func (pxy *UdpProxy) acceptPacket(addr *net.UDPAddr) bool {
+	if err := pxy.checkIp(config.GetServerCommonCfg(), addr.IP); err != nil {
+		StatsDenyConn(pxy.name)
+		// log once in a while, packets may flood
+		pxy.deniedPackets++
+		if time.Since(pxy.lastDenyLog) >= udpDenyLogInterval {
+			pxy.Warn("udp packet from [%s] denied, %v, %d packets denied since last log", addr.String(), err, pxy.deniedPackets)
+			pxy.lastDenyLog = time.Now()
+			pxy.deniedPackets = 0
+		}
+		return false
+	}
+	if !pxy.ctl.svr.pluginManager.IsSupport(plugin.OpNewUserConn) {
+		return true
+	}
+	return pxy.checkUser(addr)
+}
+
+type udpUser struct {
+	checked  bool
+	allowed  bool
+	lastSeen time.Time
+}
+
+// checkUser returns true if packets from addr are allowed by plugins. A new user is checked by plugins
+// in another goroutine, so reading packets isn't blocked, its packets are dropped until it's allowed.
+func (pxy *UdpProxy) checkUser(addr *net.UDPAddr) bool {
+	pxy.usersMu.Lock()
+	defer pxy.usersMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(pxy.lastSweep) > udpUserTimeout {
+		for key, u := range pxy.users {
+			if u.checked && now.Sub(u.lastSeen) > udpUserTimeout {
+				delete(pxy.users, key)
+			}
+		}
+		pxy.lastSweep = now
+	}
+
+	key := addr.String()
+	u, ok := pxy.users[key]
+	if ok && u.checked && now.Sub(u.lastSeen) > udpUserTimeout {
+		ok = false
+	}
+	if !ok {
+		u = &udpUser{}
+		pxy.users[key] = u
+		go pxy.checkNewUser(addr, u)
+	}
+	u.lastSeen = now
+	return u.allowed
+}
+
+func (pxy *UdpProxy) checkNewUser(addr *net.UDPAddr, u *udpUser) {
+	_, err := pxy.ctl.svr.pluginManager.NewUserConn(newUserConnContent(pxy, addr.String()))
+	if err != nil {
+		pxy.Warn("udp user [%s] rejected: %v", addr.String(), err)
+	}
+
+	pxy.usersMu.Lock()
+	u.checked = true
+	u.allowed = err == nil
+	pxy.usersMu.Unlock()
+}
+
 func (pxy *UdpProxy) GetConf() config.ProxyConf {
 	return pxy.cfg
 }
@@ -518,10 +802,36 @@ func (pxy *UdpProxy) Close() {
 	}
 }
 
+func newUserConnContent(pxy Proxy, remoteAddr string) *plugin.NewUserConnContent {
+	ctl := pxy.GetControl()
+	return &plugin.NewUserConnContent{
+		User: plugin.UserInfo{
+			User:  ctl.loginMsg.User,
+			RunId: ctl.runId,
+		},
+		ProxyName:  pxy.GetName(),
+		ProxyType:  pxy.GetConf().GetBaseInfo().ProxyType,
+		RemoteAddr: remoteAddr,
+	}
+}
+
+// userConnId is increased for each user connection, it's the conn_id field of logs.
+var userConnId uint64
+
 // HandleUserTcpConnection is used for incoming tcp user connections.
 // It can be used for tcp, http, https type.
 func HandleUserTcpConnection(pxy Proxy, userConn frpNet.Conn) {
 	defer userConn.Close()
+	connId := strconv.FormatUint(atomic.AddUint64(&userConnId, 1), 10)
+	xl := log.NewChildLogger(pxy, log.FieldConnId, connId)
+
+	// Plugins may reject connections from some users.
+	ctl := pxy.GetControl()
+	_, err := ctl.svr.pluginManager.NewUserConn(newUserConnContent(pxy, userConn.RemoteAddr().String()))
+	if err != nil {
+		xl.Warn("user connection [%s] rejected: %v", userConn.RemoteAddr().String(), err)
+		return
+	}
 
 	// try all connections from the pool
 	workConn, err := pxy.GetWorkConnFromPool()
@@ -529,27 +839,98 @@ func HandleUserTcpConnection(pxy Proxy, userConn frpNet.Conn) {
 		return
 	}
 	defer workConn.Close()
+	workConn.AddLogField(log.FieldConnId, connId)
 
 	var local io.ReadWriteCloser = workConn
 	cfg := pxy.GetConf().GetBaseInfo()
 	if cfg.UseEncryption {
-		local, err = tcp.WithEncryption(local, []byte(config.ServerCommonCfg.PrivilegeToken))
+		local, err = tcp.WithEncryption(local, []byte(pxy.GetControl().authToken))
 		if err != nil {
-			pxy.Error("create encryption stream error: %v", err)
+			xl.Error("create encryption stream error: %v", err)
 			return
 		}
 	}
 	if cfg.UseCompression {
 		local = tcp.WithCompression(local)
 	}
-	pxy.Debug("pxy [%s] join connections, workConn(l[%s] r[%s]) userConn(l[%s] r[%s])",
+	xl.Debug("pxy [%s] join connections, workConn(l[%s] r[%s]) userConn(l[%s] r[%s])",
 		pxy.GetName(), workConn.LocalAddr().String(),
 		workConn.RemoteAddr().String(), userConn.LocalAddr().String(), userConn.RemoteAddr().String())
 
+	inLimiters, outLimiters := pxy.GetLimiters()
+	inRate, outRate := StatsGetProxyRate(pxy.GetName())
+	user := &trafficConn{
+		ReadWriteCloser: userConn,
+		inLimiters:      inLimiters,
+		outLimiters:     outLimiters,
+		inRate:          inRate,
+		outRate:         outRate,
+	}
+
+	startTime := time.Now()
 	StatsOpenConnection(pxy.GetName())
-	inCount, outCount := tcp.Join(local, userConn)
+	inCount, outCount := tcp.Join(local, user)
 	StatsCloseConnection(pxy.GetName())
 	StatsAddTrafficIn(pxy.GetName(), inCount)
 	StatsAddTrafficOut(pxy.GetName(), outCount)
-	pxy.Debug("join connections closed")
+	xl.Debug("join connections closed")
+
+	if ctl.svr.connLogger != nil {
+		endTime := time.Now()
+		record := &UserConnRecord{
+			ConnId:     connId,
+			ProxyName:  pxy.GetName(),
+			ProxyType:  cfg.ProxyType,
+			RunId:      ctl.runId,
+			User:       ctl.loginMsg.User,
+			RemoteAddr: userConn.RemoteAddr().String(),
+			StartTime:  startTime,
+			EndTime:    endTime,
+			Duration:   int64(endTime.Sub(startTime) / time.Millisecond),
+			TrafficIn:  inCount,
+			TrafficOut: outCount,
+		}
+		if rc, ok := userConn.(*vhost.RequestConn); ok {
+			record.Host = rc.Host
+			record.Path = rc.Path
+		}
+		ctl.svr.connLogger.Log(record)
+	}
+}
+
+// trafficConn limits bandwidth of user connection and counts its rate,
+// in is the traffic read from user and out is the traffic written to user.
+type trafficConn struct {
+	io.ReadWriteCloser
+
+	inLimiters  []*limit.Limiter
+	outLimiters []*limit.Limiter
+
+	// nil if dashboard is disabled
+	inRate  metric.RateCounter
+	outRate metric.RateCounter
+}
+
+func (c *trafficConn) Read(p []byte) (n int, err error) {
+	n, err = c.ReadWriteCloser.Read(p)
+	waitLimiters(c.inLimiters, n)
+	if c.inRate != nil {
+		c.inRate.Inc(int64(n))
+	}
+	return
+}
+
+func (c *trafficConn) Write(p []byte) (n int, err error) {
+	waitLimiters(c.outLimiters, len(p))
+	n, err = c.ReadWriteCloser.Write(p)
+	if c.outRate != nil {
+		c.outRate.Inc(int64(n))
+	}
+	return
+}
+
+func waitLimiters(limiters []*limit.Limiter, n int) {
+	for _, l := range limiters {
+		l.WaitN(n)
+	}
 }
@@ -0,0 +1,86 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/utils/log"
+	"github.com/liudf0716/xfrps/utils/util"
+)
+
+// ConfLoader loads configures of xfrps again for reloading.
+type ConfLoader func() (*config.ServerCommonConf, error)
+
+// SetConfLoader enables reloading configures by loader.
+func (svr *Service) SetConfLoader(loader ConfLoader) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+	svr.confLoader = loader
+}
+
+// ReloadConf applies settings which can be changed without restarting, running controls and proxies are kept.
+// changed is names of applied settings, restartRequired is names of changed settings which are applied after restarting.
+func (svr *Service) ReloadConf() (changed []string, restartRequired []string, err error) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+
+	if svr.confLoader == nil {
+		err = fmt.Errorf("reloading configures is not supported")
+		return
+	}
+	newCfg, err := svr.confLoader()
+	if err != nil {
+		return
+	}
+	cfg, changed, restartRequired := config.MergeServerCommonConf(config.GetServerCommonCfg(), newCfg)
+	svr.portManager.SetPortRanges(allocPortRanges(cfg))
+	// configures are replaced as a whole, they are never changed in place
+	config.SetServerCommonCfg(cfg)
+	for _, name := range changed {
+		if name == "privilege_allow_ports" {
+			svr.revokeDisallowedProxies()
+		}
+	}
+
+	log.Info("reload configures, changed: [%s], require restart: [%s]",
+		strings.Join(changed, ","), strings.Join(restartRequired, ","))
+	return
+}
+
+// revokeDisallowedProxies closes proxies whose remote ports are not allowed by privilege_allow_ports now,
+// and frees their ports.
+func (svr *Service) revokeDisallowedProxies() {
+	allowPorts := config.GetServerCommonCfg().PrivilegeAllowPorts
+	if len(allowPorts) == 0 {
+		return
+	}
+	for _, pxy := range svr.pxyManager.GetAll() {
+		port := pxy.GetRemotePort()
+		if port == 0 || util.ContainsPort(allowPorts, port) {
+			continue
+		}
+		reason := fmt.Sprintf("remote port [%d] isn't allowed", port)
+		ctl := pxy.GetControl()
+		if err := ctl.RevokeProxy(pxy.GetName(), reason); err != nil {
+			log.Warn("revoke proxy [%s] error: %v", pxy.GetName(), err)
+			continue
+		}
+		// the proxy gets a new port in allowed ranges when it's registered again
+		svr.portManager.Free(ctl.runId, pxy.GetName())
+	}
+}
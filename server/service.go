@@ -15,12 +15,20 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/liudf0716/xfrps/assets"
 	"github.com/liudf0716/xfrps/models/config"
+	"github.com/liudf0716/xfrps/models/consts"
 	"github.com/liudf0716/xfrps/models/msg"
+	plugin "github.com/liudf0716/xfrps/models/plugin/server"
 	"github.com/liudf0716/xfrps/utils/log"
 	frpNet "github.com/liudf0716/xfrps/utils/net"
 	"github.com/liudf0716/xfrps/utils/util"
@@ -32,6 +40,31 @@ import (
 
 const (
 	connReadTimeout time.Duration = 10 * time.Second
+
+	portCheckInterval time.Duration = time.Minute
+
+	// times to allocate another port if the allocated port of proxy can't be listened
+	maxAllocRetries = 3
+
+	// source address of udp packets is checked by plugins again if it's idle for this long
+	udpUserTimeout time.Duration = time.Minute
+
+	// denied udp packets are logged at most once in this interval
+	udpDenyLogInterval time.Duration = time.Second
+
+	// work connection pools shrink if they are idle during this interval
+	poolCheckInterval time.Duration = 30 * time.Second
+
+	// statistics are saved to stats store file in this interval
+	statsSaveInterval time.Duration = 5 * time.Minute
+
+	// first byte of smux frames and TLS handshakes, for sharing bind port
+	smuxVersion      = 1
+	tlsHandshakeByte = 0x16
+
+	// default port range for allocating remote ports
+	minAllocPort = 1025
+	maxAllocPort = 65535
 )
 
 var ServerService *Service
@@ -41,6 +74,16 @@ type Service struct {
 	// Accept connections from client.
 	listener frpNet.Listener
 
+	// Accept connections from client using kcp, nil if kcp is not enabled.
+	kcpListener frpNet.Listener
+
+	// Accept connections from client using websocket on bind port, nil if websocket is not enabled.
+	websocketListener frpNet.Listener
+
+	// Accept standard TLS connections from client on bind port, nil if TLS is not enabled.
+	// It only gets handshakes not taken by vhost https or dashboard sharing bind port.
+	tlsListener frpNet.Listener
+
 	// For http proxies, route requests to different clients by hostname and other infomation.
 	VhostHttpMuxer *vhost.HttpMuxer
 
@@ -55,37 +98,192 @@ type Service struct {
 
 	// Manage all free port for each client
 	portManager *PortManager
+
+	// Count user connections of each source ip
+	ipConnManager *IpConnManager
+
+	// Run ids banned by administrator
+	banManager *BanManager
+
+	// Save statistics across restarts, nil if statistics are only kept in memory
+	statsStore StatsStore
+
+	// Credentials of each client, nil if all clients use the privilege token
+	credStore CredentialStore
+
+	// Tokens of dashboard api, nil if only dashboard user and password are used
+	tokenStore TokenStore
+
+	// Record finished user connections, nil if user connection log is disabled
+	connLogger ConnLogger
+
+	// Send login, new proxy and new user connection operations to plugins.
+	pluginManager *plugin.Manager
+
+	// TLS config for connections from client, nil if TLS is not enabled.
+	tlsConfig *tls.Config
+
+	// TLS config of dashboard, nil if dashboard doesn't have its own certificate.
+	dashboardTlsConfig *tls.Config
+
+	// Load configures again for reloading, nil if reloading is not supported.
+	confLoader ConfLoader
+	reloadMu   sync.Mutex
 }
 
 func NewService() (svr *Service, err error) {
+	cfg := config.GetServerCommonCfg()
 	svr = &Service{
-		ctlManager:  NewControlManager(),
-		pxyManager:  NewProxyManager(),
-		portManager: NewPortManager(),
+		ctlManager:    NewControlManager(),
+		pxyManager:    NewProxyManager(),
+		ipConnManager: NewIpConnManager(),
+		pluginManager: plugin.NewManager(),
+	}
+
+	// Load ports allocated before restarting.
+	var portStore PortStore
+	if cfg.PortStoreFile != "" {
+		portStore = NewJsonPortStore(cfg.PortStoreFile)
+	}
+	svr.portManager, err = NewPortManager(portStore, allocPortRanges(cfg))
+	if err != nil {
+		err = fmt.Errorf("Create port manager error, %v", err)
+		return
+	}
+	go svr.portManager.Run(portCheckInterval, time.Duration(cfg.PortExpireDays)*24*time.Hour)
+
+	// Load clients banned before restarting.
+	var banStore BanStore
+	if cfg.BanStoreFile != "" {
+		banStore = NewJsonBanStore(cfg.BanStoreFile)
+	}
+	svr.banManager, err = NewBanManager(banStore)
+	if err != nil {
+		err = fmt.Errorf("Create ban manager error, %v", err)
+		return
+	}
+
+	// Load statistics saved before restarting.
+	if cfg.StatsStoreFile != "" {
+		svr.statsStore = NewJsonStatsStore(cfg.StatsStoreFile)
+		var snapshot *StatsSnapshot
+		snapshot, err = svr.statsStore.Load()
+		if err != nil {
+			err = fmt.Errorf("Load stats store file error, %v", err)
+			return
+		}
+		if snapshot != nil {
+			StatsRestore(snapshot)
+			log.Info("load statistics of [%d] proxies and [%d] clients from stats store", len(snapshot.Proxies), len(snapshot.Clients))
+		}
+		go func() {
+			for {
+				time.Sleep(statsSaveInterval)
+				svr.SaveStats()
+			}
+		}()
+	}
+
+	// Open user connection log.
+	if cfg.UserConnLogFile != "" {
+		svr.connLogger, err = NewConnLogger(cfg.UserConnLogFile,
+			cfg.UserConnLogMaxSize, int(cfg.UserConnLogMaxFiles))
+		if err != nil {
+			err = fmt.Errorf("Open user connection log error, %v", err)
+			return
+		}
+	}
+
+	// Load tokens of dashboard api.
+	if cfg.DashboardTokenFile != "" {
+		svr.tokenStore, err = NewIniTokenStore(cfg.DashboardTokenFile)
+		if err != nil {
+			err = fmt.Errorf("Load dashboard token file error, %v", err)
+			return
+		}
+	}
+
+	// Load credentials of clients.
+	if cfg.AuthFile != "" {
+		svr.credStore, err = NewIniCredentialStore(cfg.AuthFile)
+		if err != nil {
+			err = fmt.Errorf("Load auth file error, %v", err)
+			return
+		}
+	}
+
+	// Register plugins, they are called in order of their names.
+	pluginNames := make([]string, 0, len(cfg.HttpPlugins))
+	for name := range cfg.HttpPlugins {
+		pluginNames = append(pluginNames, name)
+	}
+	sort.Strings(pluginNames)
+	for _, name := range pluginNames {
+		svr.pluginManager.Register(plugin.NewHttpPlugin(cfg.HttpPlugins[name]))
+		log.Info("plugin [%s] has been registered", name)
 	}
 
 	// Init assets.
-	err = assets.Load(config.ServerCommonCfg.AssetsDir)
+	err = assets.Load(cfg.AssetsDir)
 	if err != nil {
 		err = fmt.Errorf("Load assets error: %v", err)
 		return
 	}
 
+	// Load TLS certificates.
+	if cfg.TlsCertFile != "" {
+		svr.tlsConfig, err = frpNet.NewServerTlsConfig(cfg.TlsCertFile,
+			cfg.TlsKeyFile, cfg.TlsTrustedCaFile)
+		if err != nil {
+			err = fmt.Errorf("Load TLS certificates error, %v", err)
+			return
+		}
+	}
+	if cfg.DashboardTlsCertFile != "" {
+		svr.dashboardTlsConfig, err = frpNet.NewReloadServerTlsConfig(cfg.DashboardTlsCertFile,
+			cfg.DashboardTlsKeyFile, cfg.DashboardTlsClientCaFile)
+		if err != nil {
+			err = fmt.Errorf("Load dashboard TLS certificates error, %v", err)
+			return
+		}
+	}
+
 	// Listen for accepting connections from client.
-	svr.listener, err = frpNet.ListenTcp(config.ServerCommonCfg.BindAddr, config.ServerCommonCfg.BindPort)
+	// Vhost and dashboard can share this port, connections are dispatched by their first byte.
+	bindListener, err := frpNet.ListenTcp(cfg.BindAddr, cfg.BindPort)
 	if err != nil {
 		err = fmt.Errorf("Create server listener error, %v", err)
 		return
 	}
+	mux := frpNet.NewMux(bindListener, connReadTimeout)
+	go mux.Serve()
+	svr.listener = mux.Listen(isClientHead)
+	if cfg.EnableWebsocket {
+		svr.websocketListener = frpNet.NewWebsocketListener(frpNet.NewNetListener(mux.Listen(isWebsocketHead), bindListener.Addr))
+	}
 
-	// Create http vhost muxer.
-	if config.ServerCommonCfg.VhostHttpPort != 0 {
-		var l frpNet.Listener
-		l, err = frpNet.ListenTcp(config.ServerCommonCfg.BindAddr, config.ServerCommonCfg.VhostHttpPort)
+	// Listen for accepting kcp connections from client on udp port.
+	if cfg.Protocol == "kcp" {
+		svr.kcpListener, err = frpNet.ListenKcp(cfg.BindAddr, cfg.KcpBindPort)
 		if err != nil {
-			err = fmt.Errorf("Create vhost http listener error, %v", err)
+			err = fmt.Errorf("Create server kcp listener error, %v", err)
 			return
 		}
+		log.Info("Kcp listen on udp %s:%d", cfg.BindAddr, cfg.KcpBindPort)
+	}
+
+	// Create http vhost muxer.
+	if cfg.VhostHttpPort != 0 {
+		var l frpNet.Listener
+		if cfg.VhostHttpPort == cfg.BindPort {
+			l = mux.Listen(isHttpHead)
+		} else {
+			l, err = frpNet.ListenTcp(cfg.BindAddr, cfg.VhostHttpPort)
+			if err != nil {
+				err = fmt.Errorf("Create vhost http listener error, %v", err)
+				return
+			}
+		}
 		svr.VhostHttpMuxer, err = vhost.NewHttpMuxer(l, 30*time.Second)
 		if err != nil {
 			err = fmt.Errorf("Create vhost httpMuxer error, %v", err)
@@ -94,12 +292,16 @@ func NewService() (svr *Service, err error) {
 	}
 
 	// Create https vhost muxer.
-	if config.ServerCommonCfg.VhostHttpsPort != 0 {
+	if cfg.VhostHttpsPort != 0 {
 		var l frpNet.Listener
-		l, err = frpNet.ListenTcp(config.ServerCommonCfg.BindAddr, config.ServerCommonCfg.VhostHttpsPort)
-		if err != nil {
-			err = fmt.Errorf("Create vhost https listener error, %v", err)
-			return
+		if cfg.VhostHttpsPort == cfg.BindPort {
+			l = mux.Listen(isTlsHead)
+		} else {
+			l, err = frpNet.ListenTcp(cfg.BindAddr, cfg.VhostHttpsPort)
+			if err != nil {
+				err = fmt.Errorf("Create vhost https listener error, %v", err)
+				return
+			}
 		}
 		svr.VhostHttpsMuxer, err = vhost.NewHttpsMuxer(l, 30*time.Second)
 		if err != nil {
@@ -109,23 +311,133 @@ func NewService() (svr *Service, err error) {
 	}
 
 	// Create dashboard web server.
-	if config.ServerCommonCfg.DashboardPort == 0 {
-		config.ServerCommonCfg.DashboardPort = config.ServerCommonCfg.BindPort + 1
+	var dashboardListeners []net.Listener
+	if cfg.DashboardPort == cfg.BindPort {
+		dashboardListeners, err = svr.shareDashboardListeners(mux, bindListener.Addr)
+	} else {
+		var l net.Listener
+		l, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.BindAddr, cfg.DashboardPort))
+		if err == nil && svr.dashboardTlsConfig != nil {
+			l = tls.NewListener(l, svr.dashboardTlsConfig)
+		}
+		dashboardListeners = []net.Listener{l}
 	}
-
-	err = RunDashboardServer(config.ServerCommonCfg.BindAddr, config.ServerCommonCfg.DashboardPort)
 	if err != nil {
 		err = fmt.Errorf("Create dashboard web server error, %v", err)
 		return
 	}
-	log.Info("Dashboard listen on %s:%d", config.ServerCommonCfg.BindAddr, config.ServerCommonCfg.DashboardPort)
+	RunDashboardServer(dashboardListeners...)
+	log.Info("Dashboard listen on %s:%d", cfg.BindAddr, cfg.DashboardPort)
+
+	// Listen last, so https requests are sent to vhost https or dashboard if they share bind port.
+	if svr.tlsConfig != nil {
+		svr.tlsListener = mux.Listen(isTlsHead)
+	}
+	return
+}
+
+// allocPortRanges returns port ranges for allocating remote ports, privilege_allow_ports is used if it's set.
+// Ports listened by xfrps itself are excluded.
+func allocPortRanges(cfg *config.ServerCommonConf) [][2]int64 {
+	portRanges := cfg.PrivilegeAllowPorts
+	if len(portRanges) == 0 {
+		portRanges = [][2]int64{{minAllocPort, maxAllocPort}}
+	}
+	ownPorts := []int64{cfg.BindPort, cfg.VhostHttpPort, cfg.VhostHttpsPort, cfg.DashboardPort}
+	if cfg.Protocol == "kcp" {
+		ownPorts = append(ownPorts, cfg.KcpBindPort)
+	}
+	for _, p := range ownPorts {
+		if p != 0 {
+			portRanges = util.PortRangesCut(portRanges, p)
+		}
+	}
+	return portRanges
+}
+
+// shareDashboardListeners returns listeners for dashboard on bind port.
+// Http requests are sent to dashboard directly, or by DashboardDomain if vhost http shares bind port too.
+// If TLS certificate is set, https requests are handled in the same way.
+// If dashboard has its own certificate, it's used and http requests are not served.
+func (svr *Service) shareDashboardListeners(mux *frpNet.Mux, addr net.Addr) (lns []net.Listener, err error) {
+	cfg := config.GetServerCommonCfg()
+	routeCfg := &vhost.VhostRouteConfig{
+		Domain: cfg.DashboardDomain,
+	}
+
+	var l frpNet.Listener
+	if svr.dashboardTlsConfig == nil {
+		if cfg.VhostHttpPort == cfg.BindPort {
+			if l, err = svr.VhostHttpMuxer.Listen(routeCfg); err != nil {
+				return
+			}
+		} else {
+			l = mux.Listen(isHttpHead)
+		}
+		lns = append(lns, frpNet.NewNetListener(l, addr))
+	}
+
+	tlsConfig := svr.dashboardTlsConfig
+	if tlsConfig == nil {
+		if svr.tlsConfig == nil {
+			return
+		}
+		// dashboard never asks for client certificates of xfrpc
+		tlsConfig = svr.tlsConfig.Clone()
+		tlsConfig.ClientAuth = tls.NoClientCert
+		tlsConfig.ClientCAs = nil
+	}
+	if cfg.VhostHttpsPort == cfg.BindPort {
+		if l, err = svr.VhostHttpsMuxer.Listen(routeCfg); err != nil {
+			return
+		}
+	} else {
+		l = mux.Listen(isTlsHead)
+	}
+	lns = append(lns, tls.NewListener(frpNet.NewNetListener(l, addr), tlsConfig))
 	return
 }
 
+// isClientHead accepts connections from xfrpc, which start with a frp message type,
+// a smux frame if tcp_mux is enabled, or FrpTlsHeadByte if TLS is enabled.
+func isClientHead(head []byte) bool {
+	_, ok := msg.TypeMap[head[0]]
+	return ok || head[0] == smuxVersion || head[0] == frpNet.FrpTlsHeadByte
+}
+
+// isWebsocketHead accepts websocket upgrade requests from xfrpc.
+func isWebsocketHead(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("GET "+frpNet.FrpWebsocketPath+" "))
+}
+
+// isHttpHead accepts http requests, all http methods are upper case letters.
+func isHttpHead(head []byte) bool {
+	return head[0] >= 'A' && head[0] <= 'Z'
+}
+
+// isTlsHead accepts standard TLS handshakes.
+func isTlsHead(head []byte) bool {
+	return head[0] == tlsHandshakeByte
+}
+
 func (svr *Service) Run() {
+	if svr.kcpListener != nil {
+		go svr.handleListener(svr.kcpListener)
+	}
+	if svr.tlsListener != nil {
+		go svr.handleListener(svr.tlsListener)
+	}
+	if svr.websocketListener != nil {
+		go svr.handleListener(svr.websocketListener)
+	}
+	svr.handleListener(svr.listener)
+}
+
+// handleListener accepts connections from client until l is closed.
+func (svr *Service) handleListener(l frpNet.Listener) {
 	// Listen for incoming connections from client.
 	for {
-		c, err := svr.listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
 			log.Warn("Listener for incoming connections from client closed")
 			return
@@ -133,6 +445,22 @@ func (svr *Service) Run() {
 
 		// Start a new goroutine for dealing connections.
 		go func(frpConn frpNet.Conn) {
+			// Check whether client connects with TLS.
+			remoteAddr := frpConn.RemoteAddr().String()
+			frpConn, isTls, err := frpNet.CheckAndEnableTlsServerConn(frpConn, svr.tlsConfig, connReadTimeout)
+			if err != nil {
+				log.Warn("Failed to check TLS of connection [%s]: %v", remoteAddr, err)
+				frpConn.Close()
+				return
+			}
+			if !isTls && config.GetServerCommonCfg().TlsOnly {
+				log.Warn("Reject connection [%s] not using TLS", remoteAddr)
+				frpConn.Close()
+				return
+			}
+			// common name of client's certificate, empty if mutual TLS is not enabled
+			peerName := frpNet.PeerCommonName(frpConn)
+
 			dealFn := func(conn frpNet.Conn) {
 				var rawMsg msg.Message
 				conn.SetReadDeadline(time.Now().Add(connReadTimeout))
@@ -145,7 +473,10 @@ func (svr *Service) Run() {
 
 				switch m := rawMsg.(type) {
 				case *msg.Login:
-					err = svr.RegisterControl(conn, m)
+					err = checkPeerRunId(peerName, m.RunId)
+					if err == nil {
+						err = svr.RegisterControl(conn, m)
+					}
 					// If login failed, send error message there.
 					// Otherwise send success message in control's work goroutine.
 					if err != nil {
@@ -157,6 +488,11 @@ func (svr *Service) Run() {
 						conn.Close()
 					}
 				case *msg.NewWorkConn:
+					if err = checkPeerRunId(peerName, m.RunId); err != nil {
+						conn.Warn("%v", err)
+						conn.Close()
+						return
+					}
 					// frpc connected frps for its proxy, and store this connection in control's workConnCh
 					svr.RegisterWorkConn(conn, m)
 				default:
@@ -165,7 +501,7 @@ func (svr *Service) Run() {
 				}
 			}
 
-			if config.ServerCommonCfg.TcpMux {
+			if config.GetServerCommonCfg().TcpMux {
 				session, err := smux.Server(frpConn, nil)
 				if err != nil {
 					log.Warn("Failed to create mux connection: %v", err)
@@ -190,6 +526,17 @@ func (svr *Service) Run() {
 	}
 }
 
+// checkPeerRunId checks common name of client's certificate if tls_verify_runid is enabled.
+func checkPeerRunId(peerName string, runId string) error {
+	if !config.GetServerCommonCfg().TlsVerifyRunId {
+		return nil
+	}
+	if peerName == "" || peerName != runId {
+		return fmt.Errorf("certificate of client doesn't match RunId [%s]", runId)
+	}
+	return nil
+}
+
 func (svr *Service) RegisterControl(ctlConn frpNet.Conn, loginMsg *msg.Login) (err error) {
 	ctlConn.Info("client login info: ip [%s] version [%s] hostname [%s] os [%s] arch [%s] runId [%s]",
 		ctlConn.RemoteAddr().String(), loginMsg.Version, loginMsg.Hostname, loginMsg.Os, loginMsg.Arch, loginMsg.RunId)
@@ -201,13 +548,8 @@ func (svr *Service) RegisterControl(ctlConn frpNet.Conn, loginMsg *msg.Login) (e
 	}
 
 	// Check auth.
-	nowTime := time.Now().Unix()
-	if config.ServerCommonCfg.AuthTimeout != 0 && nowTime-loginMsg.Timestamp > config.ServerCommonCfg.AuthTimeout {
-		err = fmt.Errorf("authorization timeout")
-		return
-	}
-	if util.GetAuthKey(config.ServerCommonCfg.PrivilegeToken, loginMsg.Timestamp) != loginMsg.PrivilegeKey {
-		err = fmt.Errorf("authorization failed")
+	authToken, err := svr.authLogin(loginMsg)
+	if err != nil {
 		return
 	}
 
@@ -217,19 +559,51 @@ func (svr *Service) RegisterControl(ctlConn frpNet.Conn, loginMsg *msg.Login) (e
 		return
 	}
 
-	ctl := NewControl(svr, ctlConn, loginMsg)
-	if oldCtl := svr.ctlManager.Add(loginMsg.RunId, ctl); oldCtl != nil {
+	if reason, banned := svr.banManager.IsBanned(loginMsg.RunId); banned {
+		err = fmt.Errorf("client [%s] is banned: %s", loginMsg.RunId, reason)
+		return
+	}
+
+	// Plugins may reject the login or change its content.
+	content, err := svr.pluginManager.Login(&plugin.LoginContent{Login: *loginMsg})
+	if err != nil {
+		return
+	}
+	if content.RunId != loginMsg.RunId {
+		err = fmt.Errorf("plugin can't change RunId")
+		return
+	}
+	*loginMsg = content.Login
+
+	ctl := NewControl(svr, ctlConn, loginMsg, authToken)
+	oldCtl, err := svr.ctlManager.Add(loginMsg.RunId, ctl, config.GetServerCommonCfg().MaxClients)
+	if err != nil {
+		StatsRejectClient()
+		return
+	}
+	if oldCtl != nil {
 		oldCtl.allShutdown.WaitDown()
 	}
 
-	ctlConn.AddLogPrefix(loginMsg.RunId)
+	ctlConn.AddLogField(log.FieldRunId, loginMsg.RunId)
 	ctl.Start()
 
 	// for statistics
 	StatsNewClient(loginMsg.RunId)
+	StatsPoolSize(loginMsg.RunId, ctl.poolCount)
 	return
 }
 
+// SaveStats saves statistics to stats store file, it's called periodically and before xfrps exits.
+func (svr *Service) SaveStats() {
+	if svr.statsStore == nil {
+		return
+	}
+	if err := svr.statsStore.Save(StatsTakeSnapshot()); err != nil {
+		log.Warn("save statistics error: %v", err)
+	}
+}
+
 // RegisterWorkConn register a new work connection to control and proxies need it.
 func (svr *Service) RegisterWorkConn(workConn frpNet.Conn, newMsg *msg.NewWorkConn) {
 	ctl, exist := svr.ctlManager.GetById(newMsg.RunId)
@@ -249,3 +623,115 @@ func (svr *Service) RegisterProxy(name string, pxy Proxy) error {
 func (svr *Service) DelProxy(name string) {
 	svr.pxyManager.Del(name)
 }
+
+// CloseProxy revokes a running proxy, its client keeps online and is told the reason.
+// The data proxy of ftp proxy is revoked too.
+func (svr *Service) CloseProxy(name string, reason string) (err error) {
+	pxy, ok := svr.pxyManager.GetByName(name)
+	if !ok {
+		return fmt.Errorf("proxy [%s] not found", name)
+	}
+	ctl := pxy.GetControl()
+	if err = ctl.RevokeProxy(name, reason); err != nil {
+		return
+	}
+	if pxy.GetConf().GetBaseInfo().ProxyType == consts.FtpProxy {
+		dataName := name + consts.FtpDataProxySuffix
+		if _, ok := svr.pxyManager.GetByName(dataName); ok {
+			err = ctl.RevokeProxy(dataName, reason)
+		}
+	}
+	return
+}
+
+// KickClient disconnects an online client, it can login again unless it's banned.
+func (svr *Service) KickClient(runId string, reason string) error {
+	ctl, ok := svr.ctlManager.GetById(runId)
+	if !ok {
+		return fmt.Errorf("client [%s] is not online", runId)
+	}
+	ctl.Kick(reason)
+	return nil
+}
+
+// BanClient refuses logins of runId and kicks it if it's online.
+func (svr *Service) BanClient(runId string, reason string) {
+	svr.banManager.Ban(runId, reason)
+	if ctl, ok := svr.ctlManager.GetById(runId); ok {
+		ctl.Kick("banned: " + reason)
+	}
+}
+
+func (svr *Service) UnbanClient(runId string) error {
+	if !svr.banManager.Unban(runId) {
+		return fmt.Errorf("client [%s] is not banned", runId)
+	}
+	return nil
+}
+
+// ReleasePort frees the port allocated for one proxy of client.
+// If the proxy is running, it's moved to a new port at once.
+func (svr *Service) ReleasePort(runId string, proxyName string) (err error) {
+	pxy, running := svr.getProxyOf(runId, proxyName)
+	if running {
+		if err = checkMovable(pxy); err != nil {
+			return
+		}
+	}
+	oldPort, ok := svr.portManager.GetByName(runId, proxyName)
+	if !ok {
+		return fmt.Errorf("proxy [%s] of client [%s] has no port", proxyName, runId)
+	}
+	if !running {
+		svr.portManager.Free(runId, proxyName)
+		return
+	}
+
+	// the old port is kept until the proxy is moved, so it's not allocated again or lost if allocating fails
+	port, err := svr.portManager.Realloc(runId, proxyName, oldPort)
+	if err != nil {
+		return
+	}
+	defer svr.portManager.Release(oldPort)
+	return pxy.GetControl().MoveProxy(proxyName, port, "port released by administrator")
+}
+
+// ReassignPort changes the port allocated for one proxy of client.
+// If the proxy is running, it's moved to the new port at once.
+func (svr *Service) ReassignPort(runId string, proxyName string, port int64) (err error) {
+	pxy, running := svr.getProxyOf(runId, proxyName)
+	if running {
+		if err = checkMovable(pxy); err != nil {
+			return
+		}
+	}
+	if err = svr.portManager.Reassign(runId, proxyName, port); err != nil {
+		return
+	}
+	if !running {
+		return
+	}
+	return pxy.GetControl().MoveProxy(proxyName, port, "port reassigned by administrator")
+}
+
+// getProxyOf returns the running proxy named proxyName if it belongs to client runId.
+func (svr *Service) getProxyOf(runId string, proxyName string) (pxy Proxy, ok bool) {
+	ctl, ok := svr.ctlManager.GetById(runId)
+	if !ok {
+		return
+	}
+	pxy, ok = svr.pxyManager.GetByName(proxyName)
+	if ok && pxy.GetControl() != ctl {
+		return nil, false
+	}
+	return
+}
+
+// checkMovable returns error if the running proxy can't be moved to another port.
+// Ftp data ports are told to client by ftp proxy, so they can't be changed separately.
+func checkMovable(pxy Proxy) error {
+	if pxy.GetConf().GetBaseInfo().ProxyType != consts.TcpProxy || strings.HasSuffix(pxy.GetName(), consts.FtpDataProxySuffix) {
+		return fmt.Errorf("port of running proxy [%s] can't be changed, only tcp proxies are supported", pxy.GetName())
+	}
+	return nil
+}
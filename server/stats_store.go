@@ -0,0 +1,114 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	StatsStoreVersion = 1
+)
+
+// ProxyStatsRecord is the saved statistics of one proxy.
+type ProxyStatsRecord struct {
+	RunId     string `json:"run_id"`
+	ProxyType string `json:"proxy_type"`
+
+	// daily traffic, the first one is the day of snapshot
+	TrafficIn  []int64 `json:"traffic_in"`
+	TrafficOut []int64 `json:"traffic_out"`
+
+	// unix time, 0 means never
+	LastStartTime int64 `json:"last_start_time"`
+	LastCloseTime int64 `json:"last_close_time"`
+}
+
+// ClientStatsRecord is the saved statistics of one client.
+type ClientStatsRecord struct {
+	// unix time, 0 means never
+	LastStartTime int64 `json:"last_start_time"`
+	LastCloseTime int64 `json:"last_close_time"`
+}
+
+// StatsSnapshot is the statistics kept across restarts.
+type StatsSnapshot struct {
+	Version int `json:"version"`
+
+	// unix time when the snapshot was taken
+	SaveTime int64 `json:"save_time"`
+
+	// daily traffic of all proxies, the first one is the day of snapshot
+	TrafficIn  []int64 `json:"traffic_in"`
+	TrafficOut []int64 `json:"traffic_out"`
+
+	// indexed by proxy name
+	Proxies map[string]*ProxyStatsRecord `json:"proxies"`
+
+	// indexed by run id
+	Clients map[string]*ClientStatsRecord `json:"clients"`
+}
+
+// StatsStore saves statistics so that traffic history isn't lost when xfrps restarts.
+type StatsStore interface {
+	Load() (*StatsSnapshot, error)
+	Save(*StatsSnapshot) error
+}
+
+// JsonStatsStore keeps statistics in a json file.
+type JsonStatsStore struct {
+	path string
+}
+
+func NewJsonStatsStore(path string) *JsonStatsStore {
+	return &JsonStatsStore{
+		path: path,
+	}
+}
+
+// Load returns nil if the file doesn't exist yet.
+func (s *JsonStatsStore) Load() (snapshot *StatsSnapshot, err error) {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	snapshot = &StatsSnapshot{}
+	if err = json.Unmarshal(buf, snapshot); err != nil {
+		err = fmt.Errorf("parse stats store file [%s] error: %v", s.path, err)
+		return nil, err
+	}
+	if snapshot.Version != StatsStoreVersion {
+		err = fmt.Errorf("stats store file [%s] version [%d] is not supported", s.path, snapshot.Version)
+		return nil, err
+	}
+	if snapshot.Proxies == nil {
+		snapshot.Proxies = make(map[string]*ProxyStatsRecord)
+	}
+	if snapshot.Clients == nil {
+		snapshot.Clients = make(map[string]*ClientStatsRecord)
+	}
+	return
+}
+
+func (s *JsonStatsStore) Save(snapshot *StatsSnapshot) error {
+	return saveJsonFile(s.path, snapshot)
+}
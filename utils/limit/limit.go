@@ -0,0 +1,90 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/util"
+)
+
+// Limiter is a token bucket limiting bytes per second, a nil Limiter doesn't limit anything.
+type Limiter struct {
+	// bytes per second
+	rate int64
+	// at most one second of traffic can be sent at once after idle
+	burst int64
+
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewLimiter returns nil if rate is 0, which means no limit.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate
+}
+
+// WaitN takes n tokens from bucket, and blocks until they are refilled if bucket doesn't have enough.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	// tokens may be negative, later callers wait for the debt too
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// ParseBandwidth parses bandwidth like 512KB or 2MB to bytes per second, empty string means no limit.
+func ParseBandwidth(bandwidth string) (rate int64, err error) {
+	rate, err = util.ParseSize(bandwidth)
+	if err != nil {
+		return 0, fmt.Errorf("bandwidth [%s] is incorrect, it should be like 512KB or 2MB", bandwidth)
+	}
+	return
+}
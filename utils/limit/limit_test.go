@@ -0,0 +1,54 @@
+package limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	assert := assert.New(t)
+
+	rate, err := ParseBandwidth("2MB")
+	assert.NoError(err)
+	assert.EqualValues(2*1024*1024, rate)
+
+	rate, err = ParseBandwidth("512kb")
+	assert.NoError(err)
+	assert.EqualValues(512*1024, rate)
+
+	rate, err = ParseBandwidth("100")
+	assert.NoError(err)
+	assert.EqualValues(100, rate)
+
+	rate, err = ParseBandwidth("")
+	assert.NoError(err)
+	assert.EqualValues(0, rate)
+
+	_, err = ParseBandwidth("2Mbps")
+	assert.Error(err)
+	_, err = ParseBandwidth("-1KB")
+	assert.Error(err)
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	var l *Limiter
+	l.WaitN(100)
+	assert.Nil(NewLimiter(0))
+
+	l = NewLimiter(1000)
+	start := time.Now()
+	// burst is available at once
+	l.WaitN(1000)
+	assert.True(time.Since(start) < 100*time.Millisecond)
+
+	// then 1000 bytes per second
+	l.WaitN(300)
+	l.WaitN(200)
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 400*time.Millisecond, "elapsed %v", elapsed)
+	assert.True(elapsed < 900*time.Millisecond, "elapsed %v", elapsed)
+}
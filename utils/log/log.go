@@ -15,32 +15,127 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fatedier/beego/logs"
 )
 
 var Log *logs.BeeLogger
 
+// Keys of log fields, they are named fields in json logs and prefixes like [value] in text logs.
+const (
+	FieldRunId  = "runid"
+	FieldProxy  = "proxy"
+	FieldConnId = "conn_id"
+)
+
+var (
+	// jsonWriter is where json logs are written, nil if log format is text.
+	// In json format the log file is owned by jsonWriter, no beego adapter writes it.
+	jsonWriter io.Writer
+	jsonMu     sync.Mutex
+
+	// jsonEnabled is 1 if jsonWriter is not nil, it's read atomically by every log call
+	jsonEnabled int32
+
+	// it's read and written atomically because log level can be changed when configures are reloaded
+	jsonLevel int32 = logs.LevelWarn
+
+	// beego adapter and its params of text log file, empty if logs are written to console or in json
+	fileAdapter string
+	fileParams  string
+	fileMu      sync.Mutex
+)
+
 func init() {
 	Log = logs.NewLogger(200)
 	Log.EnableFuncCallDepth(true)
 	Log.SetLogFuncCallDepth(Log.GetLogFuncCallDepth() + 1)
 }
 
-func InitLog(logWay string, logFile string, logLevel string, maxdays int64) {
-	SetLogFile(logWay, logFile, maxdays)
+func InitLog(logWay string, logFile string, logLevel string, maxdays int64, logFormat string,
+	maxSize int64, maxFiles int, compress bool) {
+
 	SetLogLevel(logLevel)
+	SetLogFile(logWay, logFile, logFormat, maxdays, maxSize, maxFiles, compress)
 }
 
 // logWay: file or console
-func SetLogFile(logWay string, logFile string, maxdays int64) {
+// logFormat: text or json, logs are written as json lines if it's json.
+// If maxSize is larger than 0, the log file is rotated when it's larger than maxSize bytes instead of daily,
+// at most maxFiles rotated files are kept and they are compressed with gzip if compress is true.
+// Json log file is only rotated by size, log_max_days isn't applied to it.
+func SetLogFile(logWay string, logFile string, logFormat string, maxdays int64, maxSize int64, maxFiles int, compress bool) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+
+	if w, ok := jsonWriter.(*RotateWriter); ok {
+		w.Close()
+	}
+	setJsonWriter(nil)
+	if fileAdapter != "" {
+		Log.DelLogger(fileAdapter)
+		fileAdapter = ""
+		fileParams = ""
+	}
+
+	if logFormat == "json" {
+		if logWay == "console" {
+			setJsonWriter(os.Stdout)
+			return
+		}
+		w, err := NewRotateWriter(logFile, maxSize, maxFiles, compress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open log file [%s] error: %v\n", logFile, err)
+			setJsonWriter(os.Stdout)
+			return
+		}
+		setJsonWriter(w)
+		return
+	}
+
 	if logWay == "console" {
 		Log.SetLogger("console", "")
+		return
+	}
+	if maxSize > 0 {
+		fileAdapter = AdapterRotate
+		fileParams = fmt.Sprintf(`{"filename": "%s", "maxsize": %d, "maxfiles": %d, "compress": %t}`,
+			logFile, maxSize, maxFiles, compress)
 	} else {
-		params := fmt.Sprintf(`{"filename": "%s", "maxdays": %d}`, logFile, maxdays)
-		Log.SetLogger("file", params)
+		fileAdapter = "file"
+		fileParams = fmt.Sprintf(`{"filename": "%s", "maxdays": %d}`, logFile, maxdays)
 	}
+	Log.SetLogger(fileAdapter, fileParams)
+}
+
+// Reopen closes log files and opens them again, so that logs are written to new files after
+// they are moved by logrotate. Besides the log file, files of all RotateWriters like user connection log are reopened.
+func Reopen() (err error) {
+	fileMu.Lock()
+	// files of AdapterRotate and json logs are written by RotateWriters
+	if fileAdapter == "file" {
+		Log.DelLogger(fileAdapter)
+		err = Log.SetLogger(fileAdapter, fileParams)
+	}
+	fileMu.Unlock()
+
+	if errRet := reopenRotateWriters(); err == nil {
+		err = errRet
+	}
+	return
 }
 
 // value: error, warning, info, debug, trace
@@ -61,34 +156,133 @@ func SetLogLevel(logLevel string) {
 		level = 4
 	}
 	Log.SetLevel(level)
+	atomic.StoreInt32(&jsonLevel, int32(level))
 }
 
 // wrap log
 
 func Error(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelError, nil, format, v...)
+		return
+	}
 	Log.Error(format, v...)
 }
 
 func Warn(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelWarn, nil, format, v...)
+		return
+	}
 	Log.Warn(format, v...)
 }
 
 func Info(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelInfo, nil, format, v...)
+		return
+	}
 	Log.Info(format, v...)
 }
 
 func Debug(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelDebug, nil, format, v...)
+		return
+	}
 	Log.Debug(format, v...)
 }
 
 func Trace(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelTrace, nil, format, v...)
+		return
+	}
 	Log.Trace(format, v...)
 }
 
+func isJson() bool {
+	return atomic.LoadInt32(&jsonEnabled) == 1
+}
+
+// setJsonWriter must be called with jsonMu locked.
+func setJsonWriter(w io.Writer) {
+	jsonWriter = w
+	var enabled int32
+	if w != nil {
+		enabled = 1
+	}
+	atomic.StoreInt32(&jsonEnabled, enabled)
+}
+
+var levelNames = map[int]string{
+	logs.LevelError: "error",
+	logs.LevelWarn:  "warn",
+	logs.LevelInfo:  "info",
+	logs.LevelDebug: "debug",
+}
+
+// writeJson writes one json line like beego does for text logs, it must be called by the wrapper of caller directly.
+func writeJson(level int, fields []Field, format string, v ...interface{}) {
+	if int32(level) > atomic.LoadInt32(&jsonLevel) {
+		return
+	}
+	msg := format
+	if len(v) > 0 {
+		msg = fmt.Sprintf(format, v...)
+	}
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		file = "???"
+		line = 0
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writeJsonPair(buf, "time", time.Now().Format(time.RFC3339Nano))
+	writeJsonPair(buf, "level", levelNames[level])
+	writeJsonPair(buf, "file", filepath.Base(file)+":"+strconv.Itoa(line))
+	keys := make(map[string]bool)
+	prefixes := make([]string, 0)
+	for _, f := range fields {
+		if f.Key == "" {
+			prefixes = append(prefixes, f.Value)
+		} else if !keys[f.Key] {
+			keys[f.Key] = true
+			writeJsonPair(buf, f.Key, f.Value)
+		}
+	}
+	if len(prefixes) > 0 {
+		writeJsonPair(buf, "prefix", prefixes)
+	}
+	writeJsonPair(buf, "msg", msg)
+	buf.WriteString("}\n")
+
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	if jsonWriter != nil {
+		jsonWriter.Write(buf.Bytes())
+	}
+}
+
+func writeJsonPair(buf *bytes.Buffer, key string, value interface{}) {
+	if buf.Len() == 0 {
+		buf.WriteByte('{')
+	} else {
+		buf.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+}
+
 // Logger
 type Logger interface {
 	AddLogPrefix(string)
+	AddLogField(key string, value string)
 	GetAllPrefix() []string
+	GetAllField() []Field
 	ClearLogPrefix()
 	Error(string, ...interface{})
 	Warn(string, ...interface{})
@@ -97,53 +291,112 @@ type Logger interface {
 	Trace(string, ...interface{})
 }
 
+// Field is one prefix of PrefixLogger, Key is empty if it's added by AddLogPrefix.
+type Field struct {
+	Key   string
+	Value string
+}
+
 type PrefixLogger struct {
 	prefix    string
 	allPrefix []string
+	allField  []Field
 }
 
 func NewPrefixLogger(prefix string) *PrefixLogger {
 	logger := &PrefixLogger{
 		allPrefix: make([]string, 0),
+		allField:  make([]Field, 0),
 	}
 	logger.AddLogPrefix(prefix)
 	return logger
 }
 
+// NewFieldLogger returns a logger with one named field.
+func NewFieldLogger(key string, value string) *PrefixLogger {
+	logger := NewPrefixLogger("")
+	logger.AddLogField(key, value)
+	return logger
+}
+
+// NewChildLogger returns a logger with all fields of l and one more named field.
+func NewChildLogger(l Logger, key string, value string) *PrefixLogger {
+	logger := NewPrefixLogger("")
+	for _, f := range l.GetAllField() {
+		logger.AddLogField(f.Key, f.Value)
+	}
+	logger.AddLogField(key, value)
+	return logger
+}
+
 func (pl *PrefixLogger) AddLogPrefix(prefix string) {
-	if len(prefix) == 0 {
+	pl.AddLogField("", prefix)
+}
+
+// AddLogField adds a prefix which is a named field in json logs, key can be FieldRunId, FieldProxy or FieldConnId.
+func (pl *PrefixLogger) AddLogField(key string, value string) {
+	if len(value) == 0 {
 		return
 	}
 
-	pl.prefix += "[" + prefix + "] "
-	pl.allPrefix = append(pl.allPrefix, prefix)
+	pl.prefix += "[" + value + "] "
+	pl.allPrefix = append(pl.allPrefix, value)
+	pl.allField = append(pl.allField, Field{
+		Key:   key,
+		Value: value,
+	})
 }
 
 func (pl *PrefixLogger) GetAllPrefix() []string {
 	return pl.allPrefix
 }
 
+func (pl *PrefixLogger) GetAllField() []Field {
+	return pl.allField
+}
+
 func (pl *PrefixLogger) ClearLogPrefix() {
 	pl.prefix = ""
 	pl.allPrefix = make([]string, 0)
+	pl.allField = make([]Field, 0)
 }
 
 func (pl *PrefixLogger) Error(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelError, pl.allField, format, v...)
+		return
+	}
 	Log.Error(pl.prefix+format, v...)
 }
 
 func (pl *PrefixLogger) Warn(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelWarn, pl.allField, format, v...)
+		return
+	}
 	Log.Warn(pl.prefix+format, v...)
 }
 
 func (pl *PrefixLogger) Info(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelInfo, pl.allField, format, v...)
+		return
+	}
 	Log.Info(pl.prefix+format, v...)
 }
 
 func (pl *PrefixLogger) Debug(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelDebug, pl.allField, format, v...)
+		return
+	}
 	Log.Debug(pl.prefix+format, v...)
 }
 
 func (pl *PrefixLogger) Trace(format string, v ...interface{}) {
+	if isJson() {
+		writeJson(logs.LevelTrace, pl.allField, format, v...)
+		return
+	}
 	Log.Trace(pl.prefix+format, v...)
 }
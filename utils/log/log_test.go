@@ -0,0 +1,75 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonLog(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := bytes.NewBuffer(nil)
+	setJsonWriter(buf)
+	defer setJsonWriter(nil)
+	SetLogLevel("info")
+
+	xl := NewFieldLogger(FieldRunId, "abc")
+	xl.AddLogPrefix("old")
+	xl.AddLogField(FieldProxy, "ssh")
+	xl = NewChildLogger(xl, FieldConnId, "1")
+	xl.Info("get a user connection [%s]", "1.2.3.4")
+	xl.Debug("not written")
+
+	var record map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal("info", record["level"])
+	assert.Equal("abc", record["runid"])
+	assert.Equal("ssh", record["proxy"])
+	assert.Equal("1", record["conn_id"])
+	assert.Equal([]interface{}{"old"}, record["prefix"])
+	assert.Equal("get a user connection [1.2.3.4]", record["msg"])
+	assert.Equal("log_test.go:26", record["file"])
+
+	// text prefixes don't change
+	assert.Equal("[abc] [old] [ssh] [1] ", xl.prefix)
+
+	// global logger has no fields
+	buf.Reset()
+	Warn("plain message")
+	record = make(map[string]interface{})
+	assert.NoError(json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal("warn", record["level"])
+	assert.Equal("plain message", record["msg"])
+	assert.Nil(record["runid"])
+}
+
+func TestJsonLogFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "xfrps.log")
+	SetLogLevel("info")
+	SetLogFile("file", path, "json", 3, 0, 0, false)
+	defer SetLogFile("console", "", "text", 0, 0, 0, false)
+
+	// only the json writer owns the file
+	assert.Equal("", fileAdapter)
+	Info("to file")
+
+	buf, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	var record map[string]interface{}
+	assert.NoError(json.Unmarshal(buf, &record))
+	assert.Equal("to file", record["msg"])
+}
@@ -0,0 +1,279 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatedier/beego/logs"
+)
+
+const AdapterRotate = "rotate"
+
+func init() {
+	logs.Register(AdapterRotate, func() logs.Logger {
+		return &rotateLogWriter{
+			MaxFiles: 10,
+			Level:    logs.LevelTrace,
+		}
+	})
+}
+
+// RotateWriter appends to a file and rotates it when its size reaches maxSize.
+// Rotated files are named path.1, path.2 and so on, path.1 is the newest one,
+// at most maxFiles rotated files are kept. If maxSize is 0, the file is never rotated.
+// If compress is true, rotated files are compressed with gzip in background and named path.1.gz and so on,
+// files failed to be compressed are kept as path.1 and so on.
+// All RotateWriters not closed are reopened by Reopen.
+type RotateWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	compress bool
+
+	file   *os.File
+	size   int64
+	closed bool
+
+	// done when the last rotated file is compressed
+	compressWg sync.WaitGroup
+
+	mu sync.Mutex
+}
+
+var (
+	// rotateWriters are reopened when log files are moved by others
+	rotateWriters   = make(map[*RotateWriter]struct{})
+	rotateWritersMu sync.Mutex
+)
+
+func NewRotateWriter(path string, maxSize int64, maxFiles int, compress bool) (w *RotateWriter, err error) {
+	w = &RotateWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		compress: compress,
+	}
+	if err = w.open(); err != nil {
+		return nil, err
+	}
+	rotateWritersMu.Lock()
+	rotateWriters[w] = struct{}{}
+	rotateWritersMu.Unlock()
+	return
+}
+
+func (w *RotateWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, fmt.Errorf("file [%s] is closed", w.path)
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err = w.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = w.file.Write(p)
+	w.size += int64(n)
+	return
+}
+
+// Close closes the file and waits for compressing the last rotated file.
+func (w *RotateWriter) Close() (err error) {
+	rotateWritersMu.Lock()
+	delete(rotateWriters, w)
+	rotateWritersMu.Unlock()
+
+	defer w.compressWg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	err = w.file.Close()
+	w.file = nil
+	return
+}
+
+// Reopen closes the file and opens path again, it's used after the file is moved by others like logrotate.
+// It does nothing if w is closed.
+func (w *RotateWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+// open must be called with w.mu locked.
+func (w *RotateWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// rotate must be called with w.mu locked.
+func (w *RotateWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	if w.maxFiles <= 0 {
+		os.Remove(w.path)
+	} else {
+		// path.1 of last rotation may be still compressing
+		w.compressWg.Wait()
+		for _, name := range w.rotatedNames(w.maxFiles) {
+			os.Remove(name)
+		}
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			newNames := w.rotatedNames(i + 1)
+			for j, name := range w.rotatedNames(i) {
+				os.Rename(name, newNames[j])
+			}
+		}
+		name := fmt.Sprintf("%s.%d", w.path, 1)
+		if err := os.Rename(w.path, name); err != nil {
+			return err
+		}
+		if w.compress {
+			w.compressWg.Add(1)
+			go func() {
+				defer w.compressWg.Done()
+				// keep the uncompressed file if it can't be compressed, it's shifted like compressed ones
+				if err := gzipFile(name, name+".gz"); err != nil {
+					fmt.Fprintf(os.Stderr, "compress [%s] error: %v\n", name, err)
+				} else {
+					os.Remove(name)
+				}
+			}()
+		}
+	}
+	return w.open()
+}
+
+// reopenRotateWriters reopens all RotateWriters not closed and returns the first error.
+func reopenRotateWriters() (err error) {
+	rotateWritersMu.Lock()
+	writers := make([]*RotateWriter, 0, len(rotateWriters))
+	for w := range rotateWriters {
+		writers = append(writers, w)
+	}
+	rotateWritersMu.Unlock()
+
+	for _, w := range writers {
+		if errRet := w.Reopen(); errRet != nil && err == nil {
+			err = fmt.Errorf("reopen [%s] error: %v", w.path, errRet)
+		}
+	}
+	return
+}
+
+// rotatedNames returns names of the i-th rotated file, there may be an uncompressed one besides the compressed one.
+func (w *RotateWriter) rotatedNames(i int) []string {
+	name := fmt.Sprintf("%s.%d", w.path, i)
+	if w.compress {
+		return []string{name + ".gz", name}
+	}
+	return []string{name}
+}
+
+func gzipFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return
+}
+
+// rotateLogWriter is the beego adapter AdapterRotate, it writes text logs like beego's file adapter
+// but rotates the file by size. Its config is json like:
+//
+//	{"filename": "./xfrps.log", "maxsize": 104857600, "maxfiles": 10, "compress": true}
+type rotateLogWriter struct {
+	Filename string `json:"filename"`
+	MaxSize  int64  `json:"maxsize"`
+	MaxFiles int    `json:"maxfiles"`
+	Compress bool   `json:"compress"`
+	Level    int    `json:"level"`
+
+	w *RotateWriter
+}
+
+func (rl *rotateLogWriter) Init(config string) (err error) {
+	if err = json.Unmarshal([]byte(config), rl); err != nil {
+		return
+	}
+	if rl.Filename == "" {
+		return fmt.Errorf("filename of adapter [%s] is empty", AdapterRotate)
+	}
+	rl.w, err = NewRotateWriter(rl.Filename, rl.MaxSize, rl.MaxFiles, rl.Compress)
+	return
+}
+
+func (rl *rotateLogWriter) WriteMsg(when time.Time, msg string, level int) error {
+	if level > rl.Level {
+		return nil
+	}
+	_, err := rl.w.Write([]byte(when.Format("2006/01/02 15:04:05 ") + msg + "\n"))
+	return err
+}
+
+func (rl *rotateLogWriter) Destroy() {
+	rl.w.Close()
+}
+
+func (rl *rotateLogWriter) Flush() {
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conn.log")
+	w, err := NewRotateWriter(path, 10, 2, false)
+	assert.NoError(err)
+	for _, line := range []string{"111111\n", "222222\n", "333333\n", "444444\n"} {
+		_, err = w.Write([]byte(line))
+		assert.NoError(err)
+	}
+	assert.NoError(w.Close())
+
+	// each line exceeds maxSize together with the previous one, only 2 rotated files are kept
+	buf, _ := ioutil.ReadFile(path)
+	assert.Equal("444444\n", string(buf))
+	buf, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal("333333\n", string(buf))
+	buf, _ = ioutil.ReadFile(path + ".2")
+	assert.Equal("222222\n", string(buf))
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// size of existing file is counted after reopening
+	w, err = NewRotateWriter(path, 10, 2, false)
+	assert.NoError(err)
+	w.Write([]byte("555555\n"))
+	w.Close()
+	buf, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal("444444\n", string(buf))
+}
+
+func TestRotateWriterCompress(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "xfrps.log")
+	w, err := NewRotateWriter(path, 10, 2, true)
+	assert.NoError(err)
+	w.Write([]byte("111111\n"))
+	w.Write([]byte("222222\n"))
+	w.compressWg.Wait()
+
+	f, err := os.Open(path + ".1.gz")
+	if assert.NoError(err) {
+		zr, err := gzip.NewReader(f)
+		assert.NoError(err)
+		buf, _ := ioutil.ReadAll(zr)
+		assert.Equal("111111\n", string(buf))
+		f.Close()
+	}
+	_, err = os.Stat(path + ".1")
+	assert.True(os.IsNotExist(err))
+
+	// file moved by others is created again after reopening
+	assert.NoError(os.Rename(path, path+".moved"))
+	assert.NoError(w.Reopen())
+	w.Write([]byte("333333\n"))
+	w.Close()
+	buf, _ := ioutil.ReadFile(path)
+	assert.Equal("333333\n", string(buf))
+	buf, _ = ioutil.ReadFile(path + ".moved")
+	assert.Equal("222222\n", string(buf))
+}
+
+func TestRotateWriterCompressError(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// path.1.gz and path.2.gz can't be created or replaced, so rotated files are kept uncompressed
+	path := filepath.Join(dir, "xfrps.log")
+	for _, name := range []string{path + ".1.gz", path + ".2.gz"} {
+		assert.NoError(os.MkdirAll(filepath.Join(name, "busy"), 0755))
+	}
+	w, err := NewRotateWriter(path, 10, 2, true)
+	assert.NoError(err)
+	w.Write([]byte("111111\n"))
+	w.Write([]byte("222222\n"))
+	w.compressWg.Wait()
+	buf, _ := ioutil.ReadFile(path + ".1")
+	assert.Equal("111111\n", string(buf))
+
+	// uncompressed file is shifted instead of being overwritten
+	w.Write([]byte("333333\n"))
+	w.Close()
+	buf, _ = ioutil.ReadFile(path + ".2")
+	assert.Equal("111111\n", string(buf))
+	buf, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal("222222\n", string(buf))
+}
+
+func TestReopenRotateWriters(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conn.log")
+	w, err := NewRotateWriter(path, 0, 0, false)
+	assert.NoError(err)
+	w.Write([]byte("111111\n"))
+
+	// all writers not closed are reopened by Reopen
+	assert.NoError(os.Rename(path, path+".moved"))
+	assert.NoError(Reopen())
+	w.Write([]byte("222222\n"))
+	buf, _ := ioutil.ReadFile(path)
+	assert.Equal("222222\n", string(buf))
+
+	// closed writers are not reopened
+	w.Close()
+	assert.NoError(os.Remove(path))
+	assert.NoError(Reopen())
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
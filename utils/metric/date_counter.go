@@ -35,6 +35,17 @@ func NewDateCounter(reserveDays int64) DateCounter {
 	return newStandardDateCounter(reserveDays)
 }
 
+// LoadDateCounter restores counts saved on date, counts[0] is the count of date and counts[i] is the count of i days before.
+func LoadDateCounter(reserveDays int64, date time.Time, counts []int64) DateCounter {
+	c := newStandardDateCounter(reserveDays)
+	c.lastUpdateDate = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	for i := 0; i < len(counts) && i < int(c.reserveDays); i++ {
+		c.counts[i] = counts[i]
+	}
+	c.rotate(time.Now())
+	return c
+}
+
 type StandardDateCounter struct {
 	reserveDays int64
 	counts      []int64
@@ -2,6 +2,7 @@ package metric
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,3 +26,19 @@ func TestDateCounter(t *testing.T) {
 	dcTmp := dc.Snapshot()
 	assert.EqualValues(5, dcTmp.TodayCount())
 }
+
+func TestLoadDateCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	dc := LoadDateCounter(3, time.Now(), []int64{5, 4, 3, 2})
+	assert.EqualValues([]int64{5, 4, 3}, dc.GetLastDaysCount(3))
+
+	// counts saved yesterday move back one day
+	dc = LoadDateCounter(3, time.Now().AddDate(0, 0, -1), []int64{5, 4, 3})
+	assert.EqualValues([]int64{0, 5, 4}, dc.GetLastDaysCount(3))
+	dc.Inc(1)
+	assert.EqualValues(1, dc.TodayCount())
+
+	dc = LoadDateCounter(3, time.Now().AddDate(0, 0, -3), []int64{5, 4, 3})
+	assert.EqualValues([]int64{0, 0, 0}, dc.GetLastDaysCount(3))
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"sync"
+	"time"
+)
+
+// RateCounter counts bytes or events per second, averaged over last seconds.
+type RateCounter interface {
+	Rate() int64
+	Inc(int64)
+	Clear()
+}
+
+func NewRateCounter(seconds int64) RateCounter {
+	if seconds <= 0 {
+		seconds = 1
+	}
+	return &StandardRateCounter{
+		seconds:        seconds,
+		counts:         make([]int64, seconds+1),
+		lastUpdateTime: time.Now().Unix(),
+	}
+}
+
+type StandardRateCounter struct {
+	seconds int64
+	// counts[0] is the current second which is not finished, counts[1:] are last seconds
+	counts []int64
+
+	lastUpdateTime int64
+	mu             sync.Mutex
+}
+
+// Rate returns average count per second of last finished seconds.
+func (c *StandardRateCounter) Rate() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(time.Now().Unix())
+	var total int64
+	for _, count := range c.counts[1:] {
+		total += count
+	}
+	return total / c.seconds
+}
+
+func (c *StandardRateCounter) Inc(count int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(time.Now().Unix())
+	c.counts[0] += count
+}
+
+func (c *StandardRateCounter) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.counts {
+		c.counts[i] = 0
+	}
+}
+
+// rotate
+// Must hold the lock before calling this function.
+func (c *StandardRateCounter) rotate(now int64) {
+	n := now - c.lastUpdateTime
+	if n <= 0 {
+		return
+	}
+	c.lastUpdateTime = now
+	if n >= int64(len(c.counts)) {
+		for i := range c.counts {
+			c.counts[i] = 0
+		}
+		return
+	}
+	copy(c.counts[n:], c.counts[:int64(len(c.counts))-n])
+	for i := int64(0); i < n; i++ {
+		c.counts[i] = 0
+	}
+}
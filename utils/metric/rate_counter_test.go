@@ -0,0 +1,29 @@
+package metric
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := NewRateCounter(2).(*StandardRateCounter)
+	now := rc.lastUpdateTime
+	rc.counts[0] = 10
+	rc.rotate(now + 1)
+	rc.counts[0] = 30
+	rc.rotate(now + 2)
+	assert.EqualValues([]int64{0, 30, 10}, rc.counts)
+
+	rc.rotate(now + 3)
+	assert.EqualValues([]int64{0, 0, 30}, rc.counts)
+
+	rc.rotate(now + 10)
+	assert.EqualValues([]int64{0, 0, 0}, rc.counts)
+
+	rc.Inc(5)
+	rc.Clear()
+	assert.EqualValues(0, rc.Rate())
+}
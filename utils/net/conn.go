@@ -40,6 +40,35 @@ func WrapConn(c net.Conn) Conn {
 	}
 }
 
+// HeadConn returns bytes already read from the connection before reading from it again.
+type HeadConn struct {
+	Conn
+	head []byte
+}
+
+func WrapHeadConn(c Conn, head []byte) Conn {
+	return &HeadConn{
+		Conn: c,
+		head: head,
+	}
+}
+
+// Read fills p with the remaining head and bytes read from the connection,
+// because some callers expect a whole packet such as TLS ClientHello in one read.
+func (conn *HeadConn) Read(p []byte) (n int, err error) {
+	if len(conn.head) == 0 {
+		return conn.Conn.Read(p)
+	}
+	n = copy(p, conn.head)
+	conn.head = conn.head[n:]
+	if n < len(p) {
+		var n2 int
+		n2, err = conn.Conn.Read(p[n:])
+		n += n2
+	}
+	return
+}
+
 type WrapReadWriteCloserConn struct {
 	io.ReadWriteCloser
 	log.Logger
@@ -0,0 +1,148 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/log"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	kcpDataShards   = 10
+	kcpParityShards = 3
+
+	// max delay before accepting again after an error
+	kcpMaxAcceptDelay = time.Second
+)
+
+type KcpListener struct {
+	net.Addr
+	listener  net.Listener
+	accept    chan Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	log.Logger
+}
+
+func ListenKcp(bindAddr string, bindPort int64) (l *KcpListener, err error) {
+	listener, err := kcp.ListenWithOptions(fmt.Sprintf("%s:%d", bindAddr, bindPort), nil, kcpDataShards, kcpParityShards)
+	if err != nil {
+		return l, err
+	}
+	listener.SetReadBuffer(4194304)
+	listener.SetWriteBuffer(4194304)
+
+	l = &KcpListener{
+		Addr:     listener.Addr(),
+		listener: listener,
+		accept:   make(chan Conn),
+		closeCh:  make(chan struct{}),
+		Logger:   log.NewPrefixLogger(""),
+	}
+
+	go func() {
+		defer close(l.accept)
+		var delay time.Duration
+		for {
+			conn, err := listener.AcceptKCP()
+			if err != nil {
+				select {
+				case <-l.closeCh:
+					return
+				default:
+				}
+				// wait a while like net/http does, so a lasting error doesn't busy loop
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > kcpMaxAcceptDelay {
+					delay = kcpMaxAcceptDelay
+				}
+				l.Warn("accept kcp connection error: %v, retry in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-l.closeCh:
+					return
+				}
+				continue
+			}
+			delay = 0
+
+			setKcpSessionOptions(conn)
+			select {
+			case l.accept <- NewKcpConn(conn):
+			case <-l.closeCh:
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return l, err
+}
+
+func (l *KcpListener) Accept() (Conn, error) {
+	conn, ok := <-l.accept
+	if !ok {
+		return conn, fmt.Errorf("channel for kcp listener closed")
+	}
+	return conn, nil
+}
+
+func (l *KcpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+		l.listener.Close()
+	})
+	return nil
+}
+
+// Wrap for kcp session, it works as a reliable stream like TCPConn.
+type KcpConn struct {
+	net.Conn
+	log.Logger
+}
+
+func NewKcpConn(conn net.Conn) (c *KcpConn) {
+	c = &KcpConn{
+		Conn:   conn,
+		Logger: log.NewPrefixLogger(""),
+	}
+	return
+}
+
+func ConnectKcpServer(addr string) (c Conn, err error) {
+	conn, err := kcp.DialWithOptions(addr, nil, kcpDataShards, kcpParityShards)
+	if err != nil {
+		return
+	}
+	setKcpSessionOptions(conn)
+	c = NewKcpConn(conn)
+	return
+}
+
+// setKcpSessionOptions uses turbo mode of kcp, it trades bandwidth for lower latency on lossy links.
+func setKcpSessionOptions(conn *kcp.UDPSession) {
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(true)
+	conn.SetNoDelay(1, 20, 2, 1)
+	conn.SetMtu(1350)
+	conn.SetWindowSize(1024, 1024)
+	conn.SetACKNoDelay(false)
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKcp(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := ListenKcp("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+	}()
+
+	c, err := ConnectKcpServer(l.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf("kcp message %d", i)
+		_, err = c.Write([]byte(data))
+		assert.NoError(err)
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(c, buf)
+		assert.NoError(err)
+		assert.Equal(data, string(buf))
+	}
+}
+
+func TestKcpListenerClose(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := ListenKcp("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection nobody accepts doesn't block closing
+	c, err := ConnectKcpServer(l.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(l.Close())
+	assert.NoError(l.Close())
+	_, err = l.Accept()
+	assert.Error(err)
+}
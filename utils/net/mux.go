@@ -0,0 +1,194 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/log"
+)
+
+// MatchFunc checks the first bytes of a new connection to know which protocol it uses,
+// head has at least one byte.
+type MatchFunc func(head []byte) bool
+
+const muxHeadLen = 64
+
+// Mux shares one listener between different protocols,
+// each new connection is sent to the first listener whose MatchFunc accepts its first bytes.
+// The first bytes are got by one read, except http requests whose request line is read until
+// it's complete or muxHeadLen bytes are got, so it can be matched even if it's split into packets.
+type Mux struct {
+	ln      Listener
+	timeout time.Duration
+	lns     []*muxListener
+	mu      sync.RWMutex
+}
+
+func NewMux(ln Listener, timeout time.Duration) (mux *Mux) {
+	mux = &Mux{
+		ln:      ln,
+		timeout: timeout,
+		lns:     make([]*muxListener, 0),
+	}
+	return
+}
+
+// Listen returns a listener for connections accepted by match.
+func (mux *Mux) Listen(match MatchFunc) Listener {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	ln := &muxListener{
+		match:   match,
+		accept:  make(chan Conn),
+		closeCh: make(chan struct{}),
+		Logger:  log.NewPrefixLogger(""),
+	}
+	mux.lns = append(mux.lns, ln)
+	return ln
+}
+
+// Serve dispatches connections until the underlying listener is closed.
+func (mux *Mux) Serve() {
+	for {
+		c, err := mux.ln.Accept()
+		if err != nil {
+			mux.mu.RLock()
+			for _, ln := range mux.lns {
+				ln.Close()
+			}
+			mux.mu.RUnlock()
+			return
+		}
+		go mux.handle(c)
+	}
+}
+
+func (mux *Mux) handle(c Conn) {
+	head, err := mux.readHead(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	mux.mu.RLock()
+	var target *muxListener
+	for _, ln := range mux.lns {
+		if ln.match(head) {
+			target = ln
+			break
+		}
+	}
+	mux.mu.RUnlock()
+	if target == nil {
+		log.Debug("no listener for connection [%s] with first byte [%#x]", c.RemoteAddr().String(), head[0])
+		c.Close()
+		return
+	}
+	target.put(WrapHeadConn(c, head))
+}
+
+// readHead reads the first bytes of c before mux.timeout.
+func (mux *Mux) readHead(c Conn) (head []byte, err error) {
+	head = make([]byte, muxHeadLen)
+	n := 0
+	c.SetReadDeadline(time.Now().Add(mux.timeout))
+	for {
+		var m int
+		m, err = c.Read(head[n:])
+		n += m
+		if err != nil {
+			// bytes got before peer closes its writing are still dispatched
+			if err != io.EOF || n == 0 {
+				return
+			}
+			err = nil
+			break
+		}
+		if !isHttpHead(head[:n]) || bytes.IndexByte(head[:n], '\n') >= 0 || n == muxHeadLen {
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	head = head[:n]
+	return
+}
+
+// isHttpHead returns true if head may be an http request, all http methods are upper case letters.
+func isHttpHead(head []byte) bool {
+	return head[0] >= 'A' && head[0] <= 'Z'
+}
+
+type muxListener struct {
+	match   MatchFunc
+	accept  chan Conn
+	closeCh chan struct{}
+	once    sync.Once
+	log.Logger
+}
+
+func (l *muxListener) put(c Conn) {
+	select {
+	case l.accept <- c:
+	case <-l.closeCh:
+		c.Close()
+	}
+}
+
+func (l *muxListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("mux listener closed")
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() {
+		close(l.closeCh)
+	})
+	return nil
+}
+
+// NetListener wraps Listener as a net.Listener, so it can be used by packages like net/http.
+type NetListener struct {
+	ln   Listener
+	addr net.Addr
+}
+
+func NewNetListener(ln Listener, addr net.Addr) *NetListener {
+	return &NetListener{
+		ln:   ln,
+		addr: addr,
+	}
+}
+
+func (l *NetListener) Accept() (net.Conn, error) {
+	return l.ln.Accept()
+}
+
+func (l *NetListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *NetListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMux(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := ListenTcp("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewMux(ln, time.Second)
+	lowerLn := mux.Listen(func(head []byte) bool { return head[0] >= 'a' && head[0] <= 'z' })
+	upperLn := mux.Listen(func(head []byte) bool { return head[0] >= 'A' && head[0] <= 'Z' })
+	go mux.Serve()
+
+	send := func(data string) {
+		c, err := net.Dial("tcp", ln.Addr.String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte(data))
+		c.Close()
+	}
+
+	go send("lower")
+	c, err := lowerLn.Accept()
+	assert.NoError(err)
+	buf, err := ioutil.ReadAll(c)
+	assert.NoError(err)
+	assert.Equal("lower", string(buf))
+
+	go send("UPPER")
+	c, err = upperLn.Accept()
+	assert.NoError(err)
+	buf, err = ioutil.ReadAll(c)
+	assert.NoError(err)
+	assert.Equal("UPPER", string(buf))
+
+	ln.Close()
+	_, err = lowerLn.Accept()
+	assert.Error(err)
+}
+
+func TestMuxSplitRequestLine(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := ListenTcp("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	mux := NewMux(ln, time.Second)
+	wsLn := mux.Listen(func(head []byte) bool { return bytes.HasPrefix(head, []byte("GET /~!frp ")) })
+	httpLn := mux.Listen(func(head []byte) bool { return head[0] >= 'A' && head[0] <= 'Z' })
+	go mux.Serve()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr.String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("GET /~"))
+		time.Sleep(100 * time.Millisecond)
+		c.Write([]byte("!frp HTTP/1.1\r\n"))
+	}()
+
+	select {
+	case c := <-acceptCh(wsLn):
+		buf, err := ioutil.ReadAll(c)
+		assert.NoError(err)
+		assert.Equal("GET /~!frp HTTP/1.1\r\n", string(buf))
+	case <-acceptCh(httpLn):
+		t.Fatal("split request line is sent to wrong listener")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func acceptCh(ln Listener) <-chan Conn {
+	ch := make(chan Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			ch <- c
+		}
+	}()
+	return ch
+}
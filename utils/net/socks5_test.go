@@ -0,0 +1,118 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveSocks5 is a minimal socks5 server which requires username and password.
+func serveSocks5(l net.Listener, user, passwd string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			buf := make([]byte, 256)
+			// greeting: ver, nmethods, methods
+			io.ReadFull(c, buf[:2])
+			io.ReadFull(c, buf[:buf[1]])
+			c.Write([]byte{5, 2})
+			// username/password auth
+			io.ReadFull(c, buf[:2])
+			u := make([]byte, buf[1])
+			io.ReadFull(c, u)
+			io.ReadFull(c, buf[:1])
+			p := make([]byte, buf[0])
+			io.ReadFull(c, p)
+			if string(u) != user || string(p) != passwd {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+			// request: ver, cmd, rsv, atyp, addr, port
+			io.ReadFull(c, buf[:4])
+			var host string
+			switch buf[3] {
+			case 1:
+				io.ReadFull(c, buf[:4])
+				host = net.IP(buf[:4]).String()
+			case 3:
+				io.ReadFull(c, buf[:1])
+				name := make([]byte, buf[0])
+				io.ReadFull(c, name)
+				host = string(name)
+			}
+			io.ReadFull(c, buf[:2])
+			port := binary.BigEndian.Uint16(buf[:2])
+			remote, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+			if err != nil {
+				c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer remote.Close()
+			c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(remote, c)
+			io.Copy(c, remote)
+		}(c)
+	}
+}
+
+func TestConnectTcpServerBySocks5Proxy(t *testing.T) {
+	assert := assert.New(t)
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoLn.Close()
+	go func() {
+		for {
+			c, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	go serveSocks5(proxyLn, "user", "passwd")
+
+	c, err := ConnectTcpServerByProxy("socks5://user:passwd@"+proxyLn.Addr().String(), echoLn.Addr().String())
+	if assert.NoError(err) {
+		c.Write([]byte("socks5"))
+		buf := make([]byte, 6)
+		_, err = io.ReadFull(c, buf)
+		assert.NoError(err)
+		assert.Equal("socks5", string(buf))
+		c.Close()
+	}
+
+	_, err = ConnectTcpServerByProxy("socks5://user:wrong@"+proxyLn.Addr().String(), echoLn.Addr().String())
+	assert.Error(err)
+}
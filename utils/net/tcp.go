@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/liudf0716/xfrps/utils/log"
 )
@@ -114,6 +115,15 @@ func ConnectTcpServer(addr string) (c Conn, err error) {
 	return
 }
 
+// ConnectTcpServerByProxy try to connect remote server by http or socks5 proxy, according to scheme of proxyUrl.
+// If proxyUrl is empty, it will connect server directly.
+func ConnectTcpServerByProxy(proxyUrl string, serverAddr string) (c Conn, err error) {
+	if strings.HasPrefix(proxyUrl, "socks5://") {
+		return ConnectTcpServerBySocks5Proxy(proxyUrl, serverAddr)
+	}
+	return ConnectTcpServerByHttpProxy(proxyUrl, serverAddr)
+}
+
 // ConnectTcpServerByHttpProxy try to connect remote server by http proxy.
 // If httpProxy is empty, it will connect server directly.
 func ConnectTcpServerByHttpProxy(httpProxy string, serverAddr string) (c Conn, err error) {
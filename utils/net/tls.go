@@ -0,0 +1,237 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/log"
+)
+
+// FrpTlsHeadByte is sent by xfrpc before TLS handshake if tls_head_byte is enabled.
+// It's not the first byte of a standard TLS handshake (0x16), so TLS connections from xfrpc
+// and https requests can share one port. It never conflicts with frp message types which are all letters.
+// Such connections are not standard TLS, they can't pass through TLS terminating proxies.
+const FrpTlsHeadByte = 0x17
+
+// tlsHandshakeByte is the first byte of a standard TLS handshake.
+const tlsHandshakeByte = 0x16
+
+// NewServerTlsConfig loads certificate of xfrps.
+// If caFile is not empty, clients must provide certificates signed by it.
+func NewServerTlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// NewReloadServerTlsConfig is like NewServerTlsConfig, but the certificate is reloaded when its files are modified.
+// If caFile is not empty, client certificates signed by it are verified if clients provide them.
+func NewReloadServerTlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// NewClientTlsConfig creates tls config of xfrpc.
+// Server's certificate is verified by caFile, or by system roots if caFile is empty.
+// It's not verified only if insecureSkipVerify is true.
+// If certFile and keyFile are not empty, the certificate is sent to server for mutual TLS.
+func NewClientTlsConfig(certFile, keyFile, caFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// CertReloader provides the certificate for tls.Config.GetCertificate, and reloads it when its files are modified,
+// so certificates can be renewed without restarting. If the new files are invalid, the old certificate is kept.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+
+	mu sync.Mutex
+}
+
+func NewCertReloader(certFile, keyFile string) (cr *CertReloader, err error) {
+	cr = &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err = cr.reload()
+	return
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if err := cr.reload(); err != nil {
+		log.Warn("reload certificate [%s] error: %v, the old one is used", cr.certFile, err)
+	}
+	return cr.cert, nil
+}
+
+// reload must be called with cr.mu locked.
+func (cr *CertReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(cr.certModTime) && keyInfo.ModTime().Equal(cr.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		log.Info("certificate [%s] is reloaded", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no valid certificate in [%s]", caFile)
+	}
+	return pool, nil
+}
+
+// WrapTlsClientConn starts TLS on c, FrpTlsHeadByte is sent first if headByte is true.
+func WrapTlsClientConn(c Conn, tlsConfig *tls.Config, headByte bool) (out Conn, err error) {
+	if headByte {
+		if _, err = c.Write([]byte{FrpTlsHeadByte}); err != nil {
+			return
+		}
+	}
+	out = WrapConn(tls.Client(c, tlsConfig))
+	return
+}
+
+// CheckAndEnableTlsServerConn reads the first byte of c to know whether the client uses TLS,
+// either a standard handshake or one following FrpTlsHeadByte.
+// If it does and tlsConfig is not nil, the TLS handshake is done before returning,
+// so the peer certificate can be checked by the caller.
+func CheckAndEnableTlsServerConn(c Conn, tlsConfig *tls.Config, timeout time.Duration) (out Conn, isTls bool, err error) {
+	out = c
+	head := make([]byte, 1)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	if _, err = c.Read(head); err != nil {
+		return
+	}
+	if head[0] != FrpTlsHeadByte && head[0] != tlsHandshakeByte {
+		c.SetReadDeadline(time.Time{})
+		out = WrapHeadConn(c, head)
+		return
+	}
+	isTls = true
+	if tlsConfig == nil {
+		err = fmt.Errorf("TLS is not enabled")
+		return
+	}
+
+	var rawConn Conn = c
+	if head[0] == tlsHandshakeByte {
+		rawConn = WrapHeadConn(c, head)
+	}
+	tlsConn := tls.Server(rawConn, tlsConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	out = WrapConn(tlsConn)
+	return
+}
+
+// PeerCommonName returns the common name of certificate provided by client, or empty if there isn't one.
+func PeerCommonName(c Conn) string {
+	wrapConn, ok := c.(*WrapLogConn)
+	if !ok {
+		return ""
+	}
+	tlsConn, ok := wrapConn.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
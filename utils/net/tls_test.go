@@ -0,0 +1,234 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// pipe returns a pair of connected tcp connections.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+func TestCheckAndEnableTlsServerConnPlain(t *testing.T) {
+	assert := assert.New(t)
+
+	c1, c2 := pipe(t)
+	go c1.Write([]byte("login"))
+
+	conn, isTls, err := CheckAndEnableTlsServerConn(WrapConn(c2), nil, time.Second)
+	assert.NoError(err)
+	assert.False(isTls)
+
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf[:1])
+	assert.NoError(err)
+	_, err = conn.Read(buf[1:])
+	assert.NoError(err)
+	assert.Equal("login", string(buf))
+	assert.Equal("", PeerCommonName(conn))
+}
+
+func TestCheckAndEnableTlsServerConnMutual(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client_runid", ca, caKey)
+
+	serverConfig, err := NewServerTlsConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	assert.NoError(err)
+	clientConfig, err := NewClientTlsConfig(filepath.Join(dir, "client_runid.crt"), filepath.Join(dir, "client_runid.key"),
+		filepath.Join(dir, "ca.crt"), "server", false)
+	assert.NoError(err)
+
+	c1, c2 := pipe(t)
+	go func() {
+		client, _ := WrapTlsClientConn(WrapConn(c1), clientConfig, true)
+		client.Write([]byte("login"))
+	}()
+
+	conn, isTls, err := CheckAndEnableTlsServerConn(WrapConn(c2), serverConfig, time.Second)
+	assert.NoError(err)
+	assert.True(isTls)
+	assert.Equal("client_runid", PeerCommonName(conn))
+
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	assert.NoError(err)
+	assert.Equal("login", string(buf))
+
+	// client without certificate is rejected
+	clientConfig, err = NewClientTlsConfig("", "", filepath.Join(dir, "ca.crt"), "server", false)
+	assert.NoError(err)
+	c1, c2 = pipe(t)
+	go func() {
+		client, _ := WrapTlsClientConn(WrapConn(c1), clientConfig, true)
+		client.Write([]byte("login"))
+		client.Close()
+	}()
+	_, isTls, err = CheckAndEnableTlsServerConn(WrapConn(c2), serverConfig, time.Second)
+	assert.True(isTls)
+	assert.Error(err)
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	old, _ := writeCert(t, dir, "server", nil, nil)
+	cr, err := NewCertReloader(certFile, keyFile)
+	assert.NoError(err)
+	cert, err := cr.GetCertificate(nil)
+	assert.NoError(err)
+	assert.Equal(old.Raw, cert.Certificate[0])
+
+	// renewed certificate is used
+	renewed, _ := writeCert(t, dir, "server", nil, nil)
+	modTime := time.Now().Add(time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	cert, err = cr.GetCertificate(nil)
+	assert.NoError(err)
+	assert.Equal(renewed.Raw, cert.Certificate[0])
+
+	// invalid files are ignored
+	ioutil.WriteFile(certFile, []byte("invalid"), 0600)
+	modTime = modTime.Add(time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	cert, err = cr.GetCertificate(nil)
+	assert.NoError(err)
+	assert.Equal(renewed.Raw, cert.Certificate[0])
+}
+
+func TestCheckAndEnableTlsServerConnStandard(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xfrps_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+
+	serverConfig, err := NewServerTlsConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+	assert.NoError(err)
+
+	// without head byte and CA, server's certificate is verified by system roots
+	clientConfig, err := NewClientTlsConfig("", "", "", "server", false)
+	assert.NoError(err)
+	c1, c2 := pipe(t)
+	errCh := make(chan error, 1)
+	go func() {
+		client, _ := WrapTlsClientConn(WrapConn(c1), clientConfig, false)
+		_, err := client.Write([]byte("login"))
+		errCh <- err
+		client.Close()
+	}()
+	_, isTls, err := CheckAndEnableTlsServerConn(WrapConn(c2), serverConfig, time.Second)
+	assert.True(isTls)
+	assert.Error(err)
+	assert.Error(<-errCh)
+
+	clientConfig, err = NewClientTlsConfig("", "", "", "server", true)
+	assert.NoError(err)
+	c1, c2 = pipe(t)
+	go func() {
+		client, _ := WrapTlsClientConn(WrapConn(c1), clientConfig, false)
+		client.Write([]byte("login"))
+	}()
+	conn, isTls, err := CheckAndEnableTlsServerConn(WrapConn(c2), serverConfig, time.Second)
+	assert.NoError(err)
+	assert.True(isTls)
+
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	assert.NoError(err)
+	assert.Equal("login", string(buf))
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/liudf0716/xfrps/utils/log"
+
+	"golang.org/x/net/websocket"
+)
+
+// FrpWebsocketPath is the path of websocket upgrade requests from xfrpc.
+const FrpWebsocketPath = "/~!frp"
+
+// WebsocketListener accepts websocket connections from a http listener,
+// the websocket streams are used as connections between xfrpc and xfrps.
+type WebsocketListener struct {
+	net.Addr
+	ln       net.Listener
+	accept   chan Conn
+	server   *http.Server
+	closeCh  chan struct{}
+	closeOne sync.Once
+	log.Logger
+}
+
+func NewWebsocketListener(ln net.Listener) (l *WebsocketListener) {
+	l = &WebsocketListener{
+		Addr:    ln.Addr(),
+		ln:      ln,
+		accept:  make(chan Conn),
+		closeCh: make(chan struct{}),
+		Logger:  log.NewPrefixLogger(""),
+	}
+
+	muxer := http.NewServeMux()
+	muxer.Handle(FrpWebsocketPath, websocket.Handler(func(c *websocket.Conn) {
+		c.PayloadType = websocket.BinaryFrame
+		conn := newWebsocketConn(c)
+		select {
+		case l.accept <- conn:
+		case <-l.closeCh:
+			c.Close()
+			return
+		}
+		// websocket connection is closed when handler returns
+		<-conn.closeCh
+	}))
+	l.server = &http.Server{
+		Handler: muxer,
+	}
+	go l.server.Serve(ln)
+	return
+}
+
+func (l *WebsocketListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("websocket listener closed")
+	}
+}
+
+func (l *WebsocketListener) Close() error {
+	l.closeOne.Do(func() {
+		close(l.closeCh)
+		l.server.Close()
+	})
+	return nil
+}
+
+type websocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	closeCh    chan struct{}
+	closeOne   sync.Once
+	log.Logger
+}
+
+func newWebsocketConn(c *websocket.Conn) *websocketConn {
+	// RemoteAddr of websocket.Conn on server side is the origin of request, not address of client
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", c.Request().RemoteAddr)
+	return &websocketConn{
+		Conn:       c,
+		remoteAddr: remoteAddr,
+		closeCh:    make(chan struct{}),
+		Logger:     log.NewPrefixLogger(""),
+	}
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *websocketConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.closeOne.Do(func() {
+		close(c.closeCh)
+	})
+	return
+}
+
+// ConnectWebsocketServer connects xfrps with websocket.
+// If httpProxy is a http proxy, the upgrade request is sent to it without CONNECT.
+// It can be a socks5 proxy too.
+func ConnectWebsocketServer(httpProxy string, serverAddr string) (c Conn, err error) {
+	// url.URL escapes '!' in path, build it by string so xfrps can match the request line
+	config, err := websocket.NewConfig("ws://"+serverAddr+FrpWebsocketPath, "http://"+serverAddr)
+	if err != nil {
+		return
+	}
+
+	// socks5 proxy connects server for us, websocket works as no proxy is used
+	if strings.HasPrefix(httpProxy, "socks5://") {
+		conn, errRet := ConnectTcpServerBySocks5Proxy(httpProxy, serverAddr)
+		if errRet != nil {
+			return nil, errRet
+		}
+		return newWebsocketClient(config, conn)
+	}
+
+	dialAddr := serverAddr
+	if httpProxy != "" {
+		var proxyUrl *url.URL
+		if proxyUrl, err = url.Parse(httpProxy); err != nil {
+			return
+		}
+		if proxyUrl.Scheme != "http" {
+			err = fmt.Errorf("Proxy URL scheme must be http, not [%s]", proxyUrl.Scheme)
+			return
+		}
+		if proxyUrl.User != nil {
+			username := proxyUrl.User.Username()
+			passwd, _ := proxyUrl.User.Password()
+			config.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+passwd)))
+		}
+		// http proxies need absolute uri in request line
+		config.Location = &url.URL{
+			Scheme: "http",
+			Opaque: "//" + serverAddr + FrpWebsocketPath,
+			Host:   serverAddr,
+		}
+		dialAddr = proxyUrl.Host
+	}
+
+	conn, err := ConnectTcpServer(dialAddr)
+	if err != nil {
+		return
+	}
+	return newWebsocketClient(config, conn)
+}
+
+func newWebsocketClient(config *websocket.Config, conn Conn) (c Conn, err error) {
+	wsConn, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	wsConn.PayloadType = websocket.BinaryFrame
+	c = WrapConn(wsConn)
+	return
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocket(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewWebsocketListener(ln)
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		assert.Equal("127.0.0.1", c.RemoteAddr().(*net.TCPAddr).IP.String())
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	c, err := ConnectWebsocketServer("", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := []byte{0x00, 0xff, 'o', 'k'}
+	_, err = c.Write(data)
+	assert.NoError(err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(c, buf)
+	assert.NoError(err)
+	assert.Equal(data, buf)
+}
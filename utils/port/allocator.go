@@ -0,0 +1,161 @@
+// Copyright 2017 fatedier, fatedier@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package port
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liudf0716/xfrps/utils/util"
+)
+
+var (
+	ErrPortExhausted   = errors.New("no available port in port ranges")
+	ErrPortUnavailable = errors.New("port is already in use")
+)
+
+// Allocator gives out ports from some port ranges.
+// It only records which ports are used, it never binds them to check if they are available.
+type Allocator struct {
+	// all ports managed by this allocator
+	portRanges [][2]int64
+
+	// ports not allocated yet
+	freeRanges [][2]int64
+
+	used map[int64]struct{}
+	rand *rand.Rand
+
+	mu sync.Mutex
+}
+
+func NewAllocator(portRanges [][2]int64) *Allocator {
+	freeRanges := make([][2]int64, len(portRanges))
+	copy(freeRanges, portRanges)
+	return &Allocator{
+		portRanges: portRanges,
+		freeRanges: freeRanges,
+		used:       make(map[int64]struct{}),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Get allocates a random free port.
+func (a *Allocator) Get() (port int64, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var total int64
+	for _, pr := range a.freeRanges {
+		total += pr[1] - pr[0] + 1
+	}
+	if total <= 0 {
+		err = ErrPortExhausted
+		return
+	}
+
+	n := a.rand.Int63n(total)
+	for _, pr := range a.freeRanges {
+		if n <= pr[1]-pr[0] {
+			port = pr[0] + n
+			break
+		}
+		n -= pr[1] - pr[0] + 1
+	}
+	a.use(port)
+	return
+}
+
+// Acquire marks the specified port as used.
+// Ports out of the port ranges are not managed by Allocator, so they can always be acquired.
+func (a *Allocator) Acquire(port int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !util.ContainsPort(a.portRanges, port) {
+		return nil
+	}
+	if _, ok := a.used[port]; ok {
+		return ErrPortUnavailable
+	}
+	a.use(port)
+	return nil
+}
+
+// Release gives the port back so it can be allocated again.
+func (a *Allocator) Release(port int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.used[port]; !ok {
+		return
+	}
+	delete(a.used, port)
+	// port ranges may be changed after the port is allocated
+	if util.ContainsPort(a.portRanges, port) {
+		a.freeRanges = mergePortRanges(append(a.freeRanges, [2]int64{port, port}))
+	}
+}
+
+// SetPortRanges changes ports managed by this allocator.
+// Ports in use are kept until they are released, even if they are out of the new port ranges.
+func (a *Allocator) SetPortRanges(portRanges [][2]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	freeRanges := make([][2]int64, len(portRanges))
+	copy(freeRanges, portRanges)
+	for port := range a.used {
+		freeRanges = util.PortRangesCut(freeRanges, port)
+	}
+	a.portRanges = portRanges
+	a.freeRanges = freeRanges
+}
+
+// Contains returns true if the port is managed by this allocator.
+func (a *Allocator) Contains(port int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return util.ContainsPort(a.portRanges, port)
+}
+
+// use must be called with a.mu locked.
+func (a *Allocator) use(port int64) {
+	a.used[port] = struct{}{}
+	a.freeRanges = util.PortRangesCut(a.freeRanges, port)
+}
+
+// mergePortRanges sorts port ranges and merges overlapping or adjacent ones,
+// so released ports don't split free ranges into pieces.
+func mergePortRanges(portRanges [][2]int64) [][2]int64 {
+	sort.Slice(portRanges, func(i, j int) bool {
+		return portRanges[i][0] < portRanges[j][0]
+	})
+	merged := portRanges[:0]
+	for _, pr := range portRanges {
+		if n := len(merged); n > 0 && pr[0] <= merged[n-1][1]+1 {
+			if pr[1] > merged[n-1][1] {
+				merged[n-1][1] = pr[1]
+			}
+			continue
+		}
+		merged = append(merged, pr)
+	}
+	return merged
+}
@@ -0,0 +1,108 @@
+package port
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocator(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAllocator([][2]int64{{20000, 20002}, {30000, 30000}})
+	allocated := make(map[int64]struct{})
+	for i := 0; i < 4; i++ {
+		port, err := a.Get()
+		assert.NoError(err)
+		assert.True(a.Contains(port))
+		_, ok := allocated[port]
+		assert.False(ok)
+		allocated[port] = struct{}{}
+	}
+
+	_, err := a.Get()
+	assert.Equal(ErrPortExhausted, err)
+
+	a.Release(20001)
+	port, err := a.Get()
+	assert.NoError(err)
+	assert.EqualValues(20001, port)
+}
+
+func TestAllocatorReleaseMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAllocator([][2]int64{{20000, 20004}})
+	for _, port := range []int64{20001, 20002, 20003} {
+		assert.NoError(a.Acquire(port))
+	}
+	a.Release(20002)
+	a.Release(20001)
+	a.Release(20003)
+	assert.Equal([][2]int64{{20000, 20004}}, a.freeRanges)
+}
+
+func TestAllocatorAcquire(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAllocator([][2]int64{{20000, 20001}})
+	assert.NoError(a.Acquire(20000))
+	assert.Equal(ErrPortUnavailable, a.Acquire(20000))
+
+	// ports out of ranges are not managed
+	assert.NoError(a.Acquire(8080))
+	assert.NoError(a.Acquire(8080))
+
+	port, err := a.Get()
+	assert.NoError(err)
+	assert.EqualValues(20001, port)
+}
+
+func TestAllocatorSetPortRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAllocator([][2]int64{{20000, 20001}})
+	assert.NoError(a.Acquire(20000))
+
+	// port in use is kept after port ranges changed
+	a.SetPortRanges([][2]int64{{20001, 20002}})
+	assert.False(a.Contains(20000))
+	a.Release(20000)
+
+	allocated := make(map[int64]struct{})
+	for i := 0; i < 2; i++ {
+		port, err := a.Get()
+		assert.NoError(err)
+		allocated[port] = struct{}{}
+	}
+	assert.Equal(map[int64]struct{}{20001: {}, 20002: {}}, allocated)
+	_, err := a.Get()
+	assert.Equal(ErrPortExhausted, err)
+}
+
+func TestAllocatorConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAllocator([][2]int64{{20000, 20999}})
+	var (
+		wait sync.WaitGroup
+		mu   sync.Mutex
+	)
+	allocated := make(map[int64]struct{})
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				port, err := a.Get()
+				assert.NoError(err)
+				mu.Lock()
+				allocated[port] = struct{}{}
+				mu.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	assert.Len(allocated, 1000)
+}
@@ -96,6 +96,74 @@ func ContainsPort(portRanges [][2]int64, port int64) bool {
 	return false
 }
 
+// GetIpNets parses ip ranges like "192.168.1.0/24,10.0.0.1", a single ip is a range of itself.
+func GetIpNets(ipsStr string) (ipNets []*net.IPNet, err error) {
+	ipNets = make([]*net.IPNet, 0)
+	for _, s := range strings.Split(ipsStr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("ip [%s] is incorrect", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, errRet := net.ParseCIDR(s)
+		if errRet != nil {
+			return nil, fmt.Errorf("ip range [%s] is incorrect", s)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func ContainsIp(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSize parses size like 512KB or 100MB to bytes, empty string means 0.
+func ParseSize(sizeStr string) (size int64, err error) {
+	s := strings.ToUpper(strings.TrimSpace(sizeStr))
+	if s == "" {
+		return 0, nil
+	}
+
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "GB"):
+		unit = 1024 * 1024 * 1024
+		s = strings.TrimSuffix(s, "GB")
+	case strings.HasSuffix(s, "MB"):
+		unit = 1024 * 1024
+		s = strings.TrimSuffix(s, "MB")
+	case strings.HasSuffix(s, "KB"):
+		unit = 1024
+		s = strings.TrimSuffix(s, "KB")
+	case strings.HasSuffix(s, "B"):
+		s = strings.TrimSuffix(s, "B")
+	}
+
+	size, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("size [%s] is incorrect, it should be like 512KB or 100MB", sizeStr)
+	}
+	return size * unit, nil
+}
+
 func PortRangesCut(portRanges [][2]int64, port int64) [][2]int64 {
 	var tmpRanges [][2]int64
 	for _, pr := range portRanges {
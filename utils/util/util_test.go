@@ -1,6 +1,7 @@
 package util
 
 import (
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,6 +68,29 @@ func TestContainsPort(t *testing.T) {
 	}
 }
 
+func TestContainsIp(t *testing.T) {
+	assert := assert.New(t)
+
+	ipNets, err := GetIpNets("192.168.1.0/24, 10.0.0.1,2001:db8::/32")
+	assert.NoError(err)
+	assert.Equal(3, len(ipNets))
+
+	assert.True(ContainsIp(ipNets, net.ParseIP("192.168.1.100")))
+	assert.True(ContainsIp(ipNets, net.ParseIP("10.0.0.1")))
+	assert.True(ContainsIp(ipNets, net.ParseIP("2001:db8::1")))
+	assert.False(ContainsIp(ipNets, net.ParseIP("10.0.0.2")))
+	assert.False(ContainsIp(ipNets, net.ParseIP("192.168.2.1")))
+
+	ipNets, err = GetIpNets("")
+	assert.NoError(err)
+	assert.Equal(0, len(ipNets))
+
+	_, err = GetIpNets("192.168.1.0/33")
+	assert.Error(err)
+	_, err = GetIpNets("office")
+	assert.Error(err)
+}
+
 func TestPortRangesCut(t *testing.T) {
 	assert := assert.New(t)
 
@@ -84,3 +108,24 @@ func TestPortRangesCut(t *testing.T) {
 	t.Log(actual)
 	assert.Equal(expect, actual)
 }
+
+func TestParseSize(t *testing.T) {
+	assert := assert.New(t)
+
+	size, err := ParseSize("100MB")
+	assert.NoError(err)
+	assert.EqualValues(100*1024*1024, size)
+
+	size, err = ParseSize("1gb")
+	assert.NoError(err)
+	assert.EqualValues(1024*1024*1024, size)
+
+	size, err = ParseSize("")
+	assert.NoError(err)
+	assert.EqualValues(0, size)
+
+	_, err = ParseSize("10M")
+	assert.Error(err)
+	_, err = ParseSize("-1KB")
+	assert.Error(err)
+}
@@ -77,7 +77,7 @@ func (v *VhostMuxer) Listen(cfg *VhostRouteConfig) (l *Listener, err error) {
 		userName:    cfg.Username,
 		passWord:    cfg.Password,
 		mux:         v,
-		accept:      make(chan frpNet.Conn),
+		accept:      make(chan *RequestConn),
 		Logger:      log.NewPrefixLogger(""),
 	}
 	v.registryRouter.Add(cfg.Domain, cfg.Location, l)
@@ -162,7 +162,19 @@ func (v *VhostMuxer) handle(c frpNet.Conn) {
 	c = sConn
 
 	l.Debug("get new http request host [%s] path [%s]", name, path)
-	l.accept <- c
+	l.accept <- &RequestConn{
+		Conn: c,
+		Host: reqInfoMap["Host"],
+		Path: reqInfoMap["Path"],
+	}
+}
+
+// RequestConn is the connection accepted by Listener, with the host and path of its first request.
+// Path is empty for https.
+type RequestConn struct {
+	frpNet.Conn
+	Host string
+	Path string
 }
 
 type Listener struct {
@@ -172,15 +184,16 @@ type Listener struct {
 	userName    string
 	passWord    string
 	mux         *VhostMuxer // for closing VhostMuxer
-	accept      chan frpNet.Conn
+	accept      chan *RequestConn
 	log.Logger
 }
 
 func (l *Listener) Accept() (frpNet.Conn, error) {
-	conn, ok := <-l.accept
+	rc, ok := <-l.accept
 	if !ok {
 		return nil, fmt.Errorf("Listener closed")
 	}
+	var conn frpNet.Conn = rc
 
 	// if rewriteFunc is exist and rewriteHost is set
 	// rewrite http requests with a modified host header
@@ -191,11 +204,15 @@ func (l *Listener) Accept() (frpNet.Conn, error) {
 			return nil, fmt.Errorf("host header rewrite failed")
 		}
 		l.Debug("rewrite host to [%s] success", l.rewriteHost)
-		conn = sConn
+		conn = &RequestConn{
+			Conn: sConn,
+			Host: rc.Host,
+			Path: rc.Path,
+		}
 	}
 
-	for _, prefix := range l.GetAllPrefix() {
-		conn.AddLogPrefix(prefix)
+	for _, f := range l.GetAllField() {
+		conn.AddLogField(f.Key, f.Value)
 	}
 	return conn, nil
 }